@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// Content-addressed storage for mirrored attachments
+	attachmentStore interface {
+		put(hash string, r io.Reader, size int64) error
+		get(hash string) (io.ReadCloser, error)
+		remove(hash string) error
+	}
+
+	// Stores attachments in a local directory; also serves as a stand-in for S3 when testing
+	localStore struct {
+		root string
+	}
+
+	// Copies attachment data to a temporary file while hashing it, so it can be relayed and archived once fully received
+	archiveSpool struct {
+		file *os.File
+		hash hash.Hash
+		size int64
+	}
+
+	// Stores attachments in an S3-compatible bucket using path-style requests signed with AWS Signature V4
+	s3Store struct {
+		endpoint  string
+		region    string
+		bucket    string
+		accessKey string
+		secretKey string
+		client    *http.Client
+	}
+)
+
+var ErrUnknownArchiveDriver = errors.New("unknown archive driver")
+
+func newAttachmentStore(config archiveConfig) (attachmentStore, error) {
+	switch config.Driver {
+	case "":
+		return nil, nil
+	case "local":
+		if err := os.MkdirAll(config.Path, 0750); err != nil {
+			return nil, err
+		}
+		return &localStore{root: config.Path}, nil
+	case "s3":
+		region := config.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Store{
+			endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+			region:    region,
+			bucket:    config.Bucket,
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			client:    &http.Client{Timeout: 5 * time.Minute},
+		}, nil
+	default:
+		return nil, ErrUnknownArchiveDriver
+	}
+}
+
+// Objects are sharded by the first two characters of their hash to keep directories small
+func archiveKey(hash string) string {
+	return hash[:2] + "/" + hash
+}
+
+func (store *localStore) path(hash string) string {
+	return filepath.Join(store.root, filepath.FromSlash(archiveKey(hash)))
+}
+
+func (store *localStore) put(hash string, r io.Reader, _ int64) error {
+	path := store.path(hash)
+	// Content is addressed by hash, so an existing file already holds the same data
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (store *localStore) get(hash string) (io.ReadCloser, error) {
+	return os.Open(store.path(hash))
+}
+
+func (store *localStore) remove(hash string) error {
+	err := os.Remove(store.path(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (store *s3Store) request(method, hash string, body io.Reader, size int64) (*http.Response, error) {
+	objectPath := "/" + store.bucket + "/" + archiveKey(hash)
+	req, err := http.NewRequest(method, store.endpoint+objectPath, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	host := req.URL.Host
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	canonicalRequest := strings.Join([]string{
+		method,
+		(&url.URL{Path: objectPath}).EscapedPath(),
+		"",
+		"host:" + host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, store.region)
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+store.secretKey), date)
+	key = hmacSHA256(key, store.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		store.accessKey,
+		scope,
+		hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+	res, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 && !(method == http.MethodDelete && res.StatusCode == http.StatusNotFound) {
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s", method, objectPath, res.Status)
+	}
+	return res, nil
+}
+
+func (store *s3Store) put(hash string, r io.Reader, size int64) error {
+	res, err := store.request(http.MethodPut, hash, r, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (store *s3Store) get(hash string) (io.ReadCloser, error) {
+	res, err := store.request(http.MethodGet, hash, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (store *s3Store) remove(hash string) error {
+	res, err := store.request(http.MethodDelete, hash, nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func newArchiveSpool() (*archiveSpool, error) {
+	file, err := ioutil.TempFile("", "mother-attachment-")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveSpool{file: file, hash: sha256.New()}, nil
+}
+
+func (spool *archiveSpool) Write(p []byte) (int, error) {
+	n, err := spool.file.Write(p)
+	spool.hash.Write(p[:n])
+	spool.size += int64(n)
+	return n, err
+}
+
+// Saves the spooled data to the archive, returning its content hash
+func (spool *archiveSpool) commit(store attachmentStore) (string, error) {
+	hash := hex.EncodeToString(spool.hash.Sum(nil))
+	if _, err := spool.file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err := store.put(hash, spool.file, spool.size); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (spool *archiveSpool) close() {
+	spool.file.Close()
+	os.Remove(spool.file.Name())
+}
+
+// Removes archived attachments older than the retention period; objects are only deleted once nothing references them
+func (mom *Mother) pruneArchive() {
+	if mom.archive == nil || mom.config.Archive.RetentionDays <= 0 {
+		return
+	}
+	if time.Now().Sub(mom.archivePrunedAt) < time.Hour {
+		return
+	}
+	mom.archivePrunedAt = time.Now()
+	threshold := time.Now().AddDate(0, 0, -mom.config.Archive.RetentionDays)
+	owned := db.
+		Table("message_logs").
+		Select("message_logs.id").
+		Joins("JOIN conversations ON conversations.id = message_logs.conversation_id").
+		Where("conversations.mother_id = ?", mom.ID).
+		SubQuery()
+	var expired []Attachment
+	err := db.
+		Where("archive_hash <> '' AND created_at < ? AND message_log_id IN (?)", threshold, owned).
+		Find(&expired).Error
+	if err != nil {
+		mom.log.Println(err)
+		return
+	}
+	hashes := make(map[string]bool)
+	for _, attach := range expired {
+		// Updating through the model would clear the hash on attach as well
+		err := db.
+			Table("attachments").
+			Where("id = ?", attach.ID).
+			UpdateColumn("archive_hash", "").Error
+		if err != nil {
+			mom.log.Println(err)
+			continue
+		}
+		hashes[attach.ArchiveHash] = true
+	}
+	removeUnreferenced(mom.archive, hashes, func(hash string) (uint, error) {
+		var refs uint
+		err := db.Model(&Attachment{}).Where("archive_hash = ?", hash).Count(&refs).Error
+		return refs, err
+	}, mom.log)
+}
+
+// Removes archived objects no attachment refers to anymore; content is shared between identical attachments, so an
+// object may outlive some of the attachments it was archived for
+func removeUnreferenced(store attachmentStore, hashes map[string]bool, countRefs func(hash string) (uint, error),
+	logger *log.Logger) {
+	for hash := range hashes {
+		refs, err := countRefs(hash)
+		if err != nil {
+			logger.Println(err)
+			continue
+		}
+		if refs > 0 {
+			continue
+		}
+		if err := store.remove(hash); err != nil {
+			logger.Println(err)
+		}
+	}
+}
+
+// File name of an archived attachment within a !logs bundle
+func bundlePath(attach Attachment) string {
+	return fmt.Sprintf("attachments/%s-%s", attach.ArchiveHash[:12], filepath.Base(attach.Name))
+}
+
+// Writes logs and archived attachments into a zip file
+func writeLogsBundle(mom *Mother, w io.Writer, logs *bytes.Buffer, convos []Conversation) error {
+	bundle := zip.NewWriter(w)
+	f, err := bundle.Create("Logs.txt")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(logs.Bytes()); err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	for _, conv := range convos {
+		for _, msg := range conv.MessageLogs {
+			for _, attach := range msg.Attachments {
+				if attach.ArchiveHash == "" {
+					continue
+				}
+				path := bundlePath(attach)
+				if written[path] {
+					continue
+				}
+				written[path] = true
+				if err := addToBundle(mom, bundle, path, attach.ArchiveHash); err != nil {
+					mom.log.Println(err)
+				}
+			}
+		}
+	}
+	return bundle.Close()
+}
+
+func addToBundle(mom *Mother, bundle *zip.Writer, path, hash string) error {
+	r, err := mom.archive.get(hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := bundle.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
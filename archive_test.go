@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRemoveUnreferenced(t *testing.T) {
+	root, err := ioutil.TempDir("", "mother-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := &localStore{root: root}
+	const expired = "aa11"
+	const shared = "bb22"
+	for _, hash := range []string{expired, shared} {
+		if err := store.put(hash, strings.NewReader(hash), int64(len(hash))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs := map[string]uint{expired: 0, shared: 1}
+	removeUnreferenced(store, map[string]bool{expired: true, shared: true}, func(hash string) (uint, error) {
+		return refs[hash], nil
+	}, log.New(ioutil.Discard, "", 0))
+	if _, err := os.Stat(store.path(expired)); !os.IsNotExist(err) {
+		t.Errorf("unreferenced object %s was not removed", expired)
+	}
+	r, err := store.get(shared)
+	if err != nil {
+		t.Fatalf("shared object %s was removed: %v", shared, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != shared {
+		t.Errorf("shared object holds %q, want %q", data, shared)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	topicBlacklist = "blacklist"
+	topicScrub     = "scrub"
+)
+
+type (
+	// Event published on a bot's internal bus; topic names what subscribers receive it
+	busEvent interface {
+		topic() string
+	}
+
+	// Requests that a user be blacklisted, i.e. another bot in the same workspace
+	blacklistEvent struct {
+		SlackID string
+	}
+
+	// Periodic cleanup, published every TimeoutCheckInterval
+	scrubEvent struct{}
+
+	// Carries the bot's own events, as opposed to Slack's; subscribers run on the bot's event loop, one event at a time
+	eventBus struct {
+		mu          sync.Mutex
+		pending     []busEvent
+		ready       chan struct{}
+		subscribers map[string][]func(busEvent)
+	}
+)
+
+func (*blacklistEvent) topic() string { return topicBlacklist }
+func (*scrubEvent) topic() string     { return topicScrub }
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		ready:       make(chan struct{}, 1),
+		subscribers: make(map[string][]func(busEvent)),
+	}
+}
+
+func (bus *eventBus) subscribe(topic string, handler func(busEvent)) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.subscribers[topic] = append(bus.subscribers[topic], handler)
+}
+
+// Queues an event for the event loop; never blocks, so it's safe to call from anywhere, including subscribers
+func (bus *eventBus) publish(ev busEvent) {
+	bus.mu.Lock()
+	bus.pending = append(bus.pending, ev)
+	bus.mu.Unlock()
+	select {
+	case bus.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Hands queued events to their subscribers; only the event loop should call this
+func (bus *eventBus) deliver(mom *Mother) {
+	bus.mu.Lock()
+	pending := bus.pending
+	bus.pending = nil
+	bus.mu.Unlock()
+	for _, ev := range pending {
+		bus.mu.Lock()
+		handlers := bus.subscribers[ev.topic()]
+		bus.mu.Unlock()
+		for _, handler := range handlers {
+			mom.handleBusEvent(ev, handler)
+		}
+	}
+}
+
+func (mom *Mother) handleBusEvent(ev busEvent, handler func(busEvent)) {
+	defer mom.recoverPanic(ev)
+	handler(ev)
+}
+
+// Subscribes the bot's own handlers to its bus
+func (mom *Mother) subscribeHandlers() {
+	mom.bus.subscribe(topicBlacklist, func(ev busEvent) {
+		mom.blacklistUser(ev.(*blacklistEvent).SlackID)
+	})
+	mom.bus.subscribe(topicLifecycle, mom.dispatchWebhooks)
+	var dummyChanID *string
+	mom.bus.subscribe(topicScrub, func(busEvent) {
+		mom.reapConversations()
+		mom.pruneExpired(mom.chanInfo)
+		mom.pruneExpired(mom.usersInfo)
+		mom.pruneExpired(mom.namesInfo)
+		mom.pruneProcessed()
+		mom.pruneArchive()
+		mom.spoofAvailability(dummyChanID)
+	})
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
@@ -27,22 +29,44 @@ var commands map[string]func(mom *Mother, params cmdParams) bool
 
 func initCommands() {
 	commands = map[string]func(mom *Mother, params cmdParams) bool{
-		"active":    cmdActive,
-		"blacklist": cmdBlacklist,
-		"close":     cmdClose,
-		"contact":   cmdContact,
-		"help":      cmdHelp,
-		"history":   cmdHistory,
-		"invite":    cmdInvite,
-		"load":      cmdLoad,
-		"logs":      cmdLogs,
-		"reload":    cmdReload,
-		"resume":    cmdResume,
-		"unload":    cmdUnload,
-		"uptime":    cmdUptime,
+		"active":     cmdActive,
+		"blacklist":  cmdBlacklist,
+		"close":      cmdClose,
+		"contact":    cmdContact,
+		"help":       cmdHelp,
+		"history":    cmdHistory,
+		"invite":     cmdInvite,
+		"load":       cmdLoad,
+		"locale":     cmdLocale,
+		"logs":       cmdLogs,
+		"reload":     cmdReload,
+		"resume":     cmdResume,
+		"ticket":     cmdTicket,
+		"transcript": cmdTranscript,
+		"unload":     cmdUnload,
+		"uptime":     cmdUptime,
 	}
 }
 
+// Removes any of the given flags from the start of params.args, returning those found
+func parseFlags(params *cmdParams, flags ...string) map[string]bool {
+	found := make(map[string]bool)
+	for len(params.args) > 0 {
+		matched := false
+		for _, flag := range flags {
+			if params.args[0] == flag {
+				found[flag] = true
+				matched = true
+			}
+		}
+		if !matched {
+			break
+		}
+		params.args = params.args[1:]
+	}
+	return found
+}
+
 func getSlackID(tagged string) string {
 	rgx := regexp.MustCompile("<@(.*?)>")
 	res := rgx.FindStringSubmatch(tagged)
@@ -54,47 +78,77 @@ func getSlackID(tagged string) string {
 
 // Lists currently active conversations
 func cmdActive(mom *Mother, params cmdParams) bool {
-	active := make([]string, len(mom.Conversations)+1)
-	active[0] = mom.getMsg("cmdActive", nil)
-	i := 1
-	for _, conv := range mom.Conversations {
-		if !conv.Active {
-			continue
-		}
-		tagged := strings.Split(conv.SlackIDs, ",")
-		for i, ID := range tagged {
-			tagged[i] = fmt.Sprintf("<@%s>", ID)
-		}
+	page, ok := parsePage(params)
+	if !ok {
+		return false
+	}
+	convos := mom.activeConversations()
+	start, end, totalPages, ok := paginate(len(convos), page, mom.config.ThreadsPerPage)
+	if !ok {
+		return false
+	}
+	active := make([]string, end-start+1)
+	active[0] = mom.getMsg("cmdActive", []langVar{
+		{"CURRENT_PAGE", page},
+		{"TOTAL_PAGES", totalPages},
+	})
+	for i, conv := range convos[start:end] {
+		slackIDs := conv.participantIDs()
 		// Get how much time is left before conversation expires
-		timeout := time.Duration(mom.config.SessionTimeout) * time.Second
-		timeout -= time.Now().Sub(conv.UpdatedAt)
-		active[i] = mom.getMsg("cmdActiveElement", []langVar{
+		expiresAt := conv.lastUpdated().Add(time.Duration(mom.config.SessionTimeout) * time.Second)
+		timeout := expiresAt.Sub(time.Now())
+		active[i+1] = mom.getMsg("cmdActiveElement", []langVar{
 			{"THREAD_LINK", mom.getMessageLink(conv.ThreadID)},
-			{"USER_LIST", strings.Join(tagged, ", ")},
+			{"USER_LIST", mentions(slackIDs)},
+			{"USER_IDS", slackIDs},
 			{"TIME_UNTIL_EXPIRED", timeout.Round(time.Second).String()},
+			{"EXPIRES_AT", expiresAt},
 		})
-		i++
 	}
-	active = active[:i]
-	if len(active) == 1 {
+	if len(convos) == 0 {
 		active = append(active, mom.getMsg("listNone", nil))
 	}
+	if totalPages > 1 {
+		active = append(active, mom.getMsg("listPage", []langVar{
+			{"CURRENT_PAGE", page},
+			{"TOTAL_PAGES", totalPages},
+		}))
+	}
 	msg := strings.Join(active, "\n")
-	mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, params.chanID, slack.RTMsgOptionTS(params.threadID)))
+	mom.sendMessage(params.chanID, params.threadID, msg)
 	return true
 }
 
 func cmdBlacklist(mom *Mother, params cmdParams) bool {
-	// Print list of blacklisted users without parameters
-	if len(params.args) == 0 {
+	// Print list of blacklisted users without parameters, or with only a page number
+	if len(params.args) == 0 || (len(params.args) == 1 && getSlackID(params.args[0]) == "" && params.args[0] != "rm") {
+		page, ok := parsePage(params)
+		if !ok {
+			return false
+		}
+		mom.prefsMu.RLock()
 		tagged := make([]string, len(mom.BlacklistedUsers))
 		for i, bu := range mom.BlacklistedUsers {
 			tagged[i] = fmt.Sprintf("<@%s>", bu.SlackID)
 		}
+		mom.prefsMu.RUnlock()
 		// It won't be alphabetical, but at least keeps the list order consistent
 		sort.Strings(tagged)
-		msg := mom.getMsg("cmdBlacklist", nil) + strings.Join(tagged, ", ")
-		mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, params.chanID, slack.RTMsgOptionTS(params.threadID)))
+		start, end, totalPages, ok := paginate(len(tagged), page, mom.config.ThreadsPerPage)
+		if !ok {
+			return false
+		}
+		msg := mom.getMsg("cmdBlacklist", []langVar{
+			{"CURRENT_PAGE", page},
+			{"TOTAL_PAGES", totalPages},
+		}) + strings.Join(tagged[start:end], ", ")
+		if totalPages > 1 {
+			msg += "\n" + mom.getMsg("listPage", []langVar{
+				{"CURRENT_PAGE", page},
+				{"TOTAL_PAGES", totalPages},
+			})
+		}
+		mom.sendMessage(params.chanID, params.threadID, msg)
 		return true
 	}
 	// Flag that the operation is a removal
@@ -116,8 +170,8 @@ func cmdBlacklist(mom *Mother, params cmdParams) bool {
 		if !isBot {
 			mothers.Range(func(_, value interface{}) bool {
 				other := value.(*Mother)
-				if other.rtm.GetInfo().Team.ID == mom.rtm.GetInfo().Team.ID {
-					if other.rtm.GetInfo().User.ID == ID {
+				if other.info().Team.ID == mom.info().Team.ID {
+					if other.info().User.ID == ID {
 						isBot = true
 						return false
 					}
@@ -141,6 +195,18 @@ func cmdBlacklist(mom *Mother, params cmdParams) bool {
 	return res
 }
 
+// Parses the optional page number given as the only argument
+func parsePage(params cmdParams) (int, bool) {
+	if len(params.args) == 0 {
+		return 1, true
+	}
+	if len(params.args) > 1 {
+		return 0, false
+	}
+	page, err := strconv.Atoi(params.args[0])
+	return page, err == nil && page > 0
+}
+
 // Deactivates conversation specified by threadID/users
 func cmdClose(mom *Mother, params cmdParams) bool {
 	if len(params.args) == 0 {
@@ -233,7 +299,7 @@ func cmdHelp(mom *Mother, params cmdParams) bool {
 		key := "cmdHelp" + strings.ToUpper(cmd[0:1]) + cmd[1:]
 		msg = mom.getMsg(key, nil) + "\n"
 	}
-	mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, params.chanID, slack.RTMsgOptionTS(params.threadID)))
+	mom.sendMessage(params.chanID, params.threadID, msg)
 	return true
 }
 
@@ -241,6 +307,7 @@ func cmdHelp(mom *Mother, params cmdParams) bool {
 func cmdHistory(mom *Mother, params cmdParams) bool {
 	var slackIDs []string
 	page := 1
+	flags := parseFlags(&params, "-i")
 	if len(params.args) > 0 {
 		for _, tagged := range params.args {
 			ID := getSlackID(tagged)
@@ -249,7 +316,6 @@ func cmdHistory(mom *Mother, params cmdParams) bool {
 			}
 			slackIDs = append(slackIDs, ID)
 		}
-		sort.Strings(slackIDs)
 		params.args = params.args[len(slackIDs):]
 	}
 	if len(params.args) > 0 {
@@ -262,9 +328,10 @@ func cmdHistory(mom *Mother, params cmdParams) bool {
 	var err error
 	var totalRecords uint
 	if len(slackIDs) > 0 {
-		err = db.
+		err = mom.
+			conversationsWithUsers(slackIDs, flags["-i"]).
 			Model(&Conversation{}).
-			Where("mother_id = ? AND slack_ids = ?", mom.ID, strings.Join(slackIDs, ",")).
+			Preload("Participants").
 			Order("updated_at desc, id desc").
 			Count(&totalRecords).
 			Limit(mom.config.ThreadsPerPage).
@@ -274,6 +341,7 @@ func cmdHistory(mom *Mother, params cmdParams) bool {
 		err = db.
 			Model(&Conversation{}).
 			Where("mother_id = ?", mom.ID, ).
+			Preload("Participants").
 			Order("updated_at desc, id desc").
 			Count(&totalRecords).
 			Limit(mom.config.ThreadsPerPage).
@@ -287,19 +355,21 @@ func cmdHistory(mom *Mother, params cmdParams) bool {
 	threads := make([]string, len(convos)+1)
 	totalPages := math.Ceil(float64(totalRecords) / float64(mom.config.ThreadsPerPage))
 	threads[0] = mom.getMsg("cmdHistory", []langVar{
-		{"CURRENT_PAGE", strconv.Itoa(page)},
-		{"TOTAL_PAGES", strconv.Itoa(int(totalPages))},
+		{"CURRENT_PAGE", page},
+		{"TOTAL_PAGES", int(totalPages)},
 	})
 	i := 1
 	for _, conv := range convos {
-		tagged := strings.Split(conv.SlackIDs, ",")
-		for i, ID := range tagged {
-			tagged[i] = fmt.Sprintf("<@%s>", ID)
-		}
+		slackIDs := conv.participantIDs()
 		threads[i] = mom.getMsg("cmdHistoryElement", []langVar{
 			{"THREAD_LINK", mom.getMessageLink(conv.ThreadID)},
-			{"USER_LIST", strings.Join(tagged, ", ")},
+			{"USER_LIST", mentions(slackIDs)},
+			{"USER_IDS", slackIDs},
 			{"LAST_UPDATED", conv.UpdatedAt.String()},
+			{"UPDATED_AT", conv.UpdatedAt},
+			{"TICKET_ID", conv.TicketID},
+			{"TICKET_URL", conv.TicketURL},
+			{"TICKET_LINK", ticketLink(conv.TicketID, conv.TicketURL)},
 		})
 		i++
 	}
@@ -310,7 +380,7 @@ func cmdHistory(mom *Mother, params cmdParams) bool {
 		threads = append(threads, mom.getMsg("listNone", nil))
 	}
 	msg := strings.Join(threads, "\n")
-	mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, params.chanID, slack.RTMsgOptionTS(params.threadID)))
+	mom.sendMessage(params.chanID, params.threadID, msg)
 	return true
 }
 
@@ -327,7 +397,9 @@ func cmdInvite(mom *Mother, params cmdParams) bool {
 		}
 		slackIDs = append(slackIDs, ID)
 	}
-	mom.invited = append(mom.invited, slackIDs...)
+	for _, ID := range slackIDs {
+		mom.inviteMember(ID)
+	}
 	_, err := mom.rtm.InviteUsersToConversation(mom.config.ChanID, slackIDs...)
 	if err != nil {
 		mom.log.Println(err)
@@ -335,29 +407,119 @@ func cmdInvite(mom *Mother, params cmdParams) bool {
 	return err == nil
 }
 
+// Sets preferred locale for messages sent to specified users
+func cmdLocale(mom *Mother, params cmdParams) bool {
+	if len(params.args) < 2 {
+		return false
+	}
+	locale := params.args[len(params.args)-1]
+	if strings.EqualFold(locale, "default") {
+		locale = ""
+	} else if _, present := mom.config.locales[strings.ToLower(locale)]; !present {
+		return false
+	}
+	slackIDs := make([]string, 0)
+	for _, tagged := range params.args[:len(params.args)-1] {
+		ID := getSlackID(tagged)
+		if ID == "" {
+			return false
+		}
+		slackIDs = append(slackIDs, ID)
+	}
+	for _, ID := range slackIDs {
+		if !mom.setUserLocale(ID, locale) {
+			return false
+		}
+	}
+	return true
+}
+
 // Writes MessageLog slice to buffer
 func writeLogs(mom *Mother, buff *bytes.Buffer, logs []MessageLog) error {
+	return writeLogsAs(mom, buff, logs, nil)
+}
+
+// Writes a conversation's logs for its students to read; with the team persona, staff appear under the team's name
+// just as they do in the students' direct messages
+func writeStudentLogs(mom *Mother, buff *bytes.Buffer, conv *Conversation) error {
+	if mom.config.StaffIdentity != identityTeam {
+		return writeLogs(mom, buff, conv.MessageLogs)
+	}
+	students := make(map[string]bool)
+	for _, slackID := range conv.participantIDs() {
+		students[slackID] = true
+	}
+	return writeLogsAs(mom, buff, conv.MessageLogs, func(slackID string) bool {
+		return !students[slackID]
+	})
+}
+
+// Writes logs, naming the authors isStaff reports as the team and hiding staff mentions; staff are named
+// individually when isStaff is nil
+func writeLogsAs(mom *Mother, buff *bytes.Buffer, logs []MessageLog, isStaff func(slackID string) bool) error {
 	for _, msg := range logs {
-		if msg.Msg != "" {
-			userInfo, err := mom.getUserInfo(msg.SlackID)
+		text := msg.Msg
+		// Content that arrived in blocks or legacy attachments is only kept in the raw payload
+		if extra := payloadText(msg.Raw); len(extra) > 0 {
+			text = strings.TrimSpace(strings.Join(append([]string{text}, extra...), "\n"))
+		}
+		if text == "" && len(msg.Attachments) == 0 {
+			continue
+		}
+		epoch, _ := strconv.ParseInt(strings.Split(msg.ConvTimestamp, ".")[0], 10, 64)
+		slackID := msg.SlackID
+		var displayName string
+		if isStaff != nil {
+			text = mom.hideStaffMentions(text)
+		}
+		if isStaff != nil && isStaff(slackID) {
+			displayName = mom.config.TeamName
+			slackID = ""
+		} else {
+			userInfo, err := mom.getUserInfo(slackID)
 			if err != nil {
 				return err
 			}
-			var format string
-			if msg.Original {
-				format = "cmdLogsMsg"
-			} else {
-				format = "cmdLogsMsgEdited"
-			}
-			epoch, _ := strconv.ParseInt(strings.Split(msg.ConvTimestamp, ".")[0], 10, 64)
-			displayName := userInfo.Profile.DisplayName
+			displayName = userInfo.Profile.DisplayName
 			if displayName == "" {
 				displayName = userInfo.Name
 			}
+		}
+		if text != "" {
+			// Templates can handle edits in cmdLogsMsg with EDITED if cmdLogsMsgEdited is left empty
+			format := "cmdLogsMsg"
+			if !msg.Original && mom.config.Lang["cmdLogsMsgEdited"] != "" {
+				format = "cmdLogsMsgEdited"
+			}
 			buff.WriteString(mom.getMsg(format, []langVar{
 				{"TIMESTAMP", time.Unix(epoch, 0).String()},
+				{"TIME", time.Unix(epoch, 0)},
 				{"DISPLAY_NAME", displayName},
-				{"MESSAGE", msg.Msg},
+				{"SLACK_ID", slackID},
+				{"MESSAGE", mom.decodeMarkup(text)},
+				{"EDITED", !msg.Original},
+			}))
+		}
+		for _, attach := range msg.Attachments {
+			fileURL := attach.ConvURL
+			if fileURL == "" {
+				fileURL = attach.DirectURL
+			}
+			var archivePath string
+			if attach.ArchiveHash != "" {
+				archivePath = bundlePath(attach)
+			}
+			buff.WriteString(mom.getMsg("cmdLogsAttachment", []langVar{
+				{"TIMESTAMP", time.Unix(epoch, 0).String()},
+				{"TIME", time.Unix(epoch, 0)},
+				{"DISPLAY_NAME", displayName},
+				{"SLACK_ID", slackID},
+				{"FILE_NAME", attach.Name},
+				{"FILE_TYPE", attach.Filetype},
+				{"FILE_SIZE", attach.Size},
+				{"FILE_URL", fileURL},
+				{"ARCHIVE_PATH", archivePath},
+				{"STATUS", mom.getMsg(attachmentStatusKeys[attach.Status], nil)},
 			}))
 		}
 	}
@@ -400,14 +562,10 @@ func cmdLogs(mom *Mother, params cmdParams) bool {
 	if len(params.args) == 0 {
 		return false
 	}
-	// Flag whether or not log output is merged
-	merged := false
-	if params.args[0] == "-m" {
-		if len(params.args) < 2 {
-			return false
-		}
-		merged = true
-		params.args = params.args[1:]
+	// Flag whether or not log output is merged, and whether to include conversations with additional users
+	flags := parseFlags(&params, "-m", "-i")
+	if len(params.args) == 0 {
+		return false
 	}
 	var convos []Conversation
 	var err error
@@ -416,6 +574,7 @@ func cmdLogs(mom *Mother, params cmdParams) bool {
 		err = db.
 			Where("mother_id = ? AND thread_id = ?", mom.ID, params.args[0]).
 			Preload("MessageLogs").
+			Preload("MessageLogs.Attachments").
 			Find(&convos).Error
 	} else if ID != "" {
 		slackIDs := make([]string, 0)
@@ -426,10 +585,10 @@ func cmdLogs(mom *Mother, params cmdParams) bool {
 			}
 			slackIDs = append(slackIDs, ID)
 		}
-		sort.Strings(slackIDs)
-		err = db.
-			Where("mother_id = ? AND slack_ids LIKE ?", mom.ID, strings.Join(slackIDs, ",")).
+		err = mom.
+			conversationsWithUsers(slackIDs, flags["-i"]).
 			Preload("MessageLogs").
+			Preload("MessageLogs.Attachments").
 			Find(&convos).Error
 	}
 	if err != nil {
@@ -439,7 +598,7 @@ func cmdLogs(mom *Mother, params cmdParams) bool {
 		return false
 	}
 	buff := &bytes.Buffer{}
-	if merged {
+	if flags["-m"] {
 		err = buildMergedLogsOutput(mom, buff, convos)
 	} else {
 		err = buildLogsOutput(mom, buff, convos)
@@ -450,9 +609,12 @@ func cmdLogs(mom *Mother, params cmdParams) bool {
 	}
 	if buff.Len() == 0 {
 		msg := mom.getMsg("cmdLogsNoRecords", nil)
-		mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, params.chanID, slack.RTMsgOptionTS(params.threadID)))
+		mom.sendMessage(params.chanID, params.threadID, msg)
 		return true
 	}
+	if mom.archive != nil && hasArchivedAttachments(convos) {
+		return uploadLogsBundle(mom, params, buff, convos)
+	}
 	_, err = mom.rtm.UploadFile(
 		slack.FileUploadParameters{
 			Reader:          buff,
@@ -467,8 +629,53 @@ func cmdLogs(mom *Mother, params cmdParams) bool {
 	return err == nil
 }
 
+func hasArchivedAttachments(convos []Conversation) bool {
+	for _, conv := range convos {
+		for _, msg := range conv.MessageLogs {
+			for _, attach := range msg.Attachments {
+				if attach.ArchiveHash != "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Uploads logs along with archived attachments as a zip file
+func uploadLogsBundle(mom *Mother, params cmdParams, logs *bytes.Buffer, convos []Conversation) bool {
+	tmp, err := ioutil.TempFile("", "mother-logs-")
+	if err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err = writeLogsBundle(mom, tmp, logs, convos); err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	_, err = mom.rtm.UploadFile(
+		slack.FileUploadParameters{
+			Reader:          tmp,
+			Filetype:        "zip",
+			Filename:        "Logs.zip",
+			Channels:        []string{params.chanID},
+			ThreadTimestamp: params.threadID,
+		},
+	)
+	if err != nil {
+		mom.log.Println(err)
+	}
+	return err == nil
+}
+
 // Resumes conversation session specified by threadID/users
 func cmdResume(mom *Mother, params cmdParams) bool {
+	flags := parseFlags(&params, "-i")
 	if len(params.args) == 0 {
 		return false
 	}
@@ -491,9 +698,8 @@ func cmdResume(mom *Mother, params cmdParams) bool {
 			slackIDs = append(slackIDs, ID)
 		}
 		conv = &Conversation{}
-		sort.Strings(slackIDs)
-		err := db.
-			Where("mother_id = ? AND slack_ids = ?", mom.ID, strings.Join(slackIDs, ",")).
+		err := mom.
+			conversationsWithUsers(slackIDs, flags["-i"]).
 			Order("updated_at desc, id desc").
 			First(conv).Error
 		if err != nil {
@@ -517,6 +723,83 @@ func cmdResume(mom *Mother, params cmdParams) bool {
 	return err == nil
 }
 
+// Loads the conversation whose thread the command was sent in, or else the one given by threadID as the first argument,
+// which is then removed from params.args
+func commandConversation(mom *Mother, params *cmdParams) *Conversation {
+	conv := &Conversation{mom: mom}
+	query := db.
+		Preload("MessageLogs").
+		Preload("MessageLogs.Attachments").
+		Preload("Participants")
+	err := query.Where("mother_id = ? AND thread_id = ?", mom.ID, params.threadID).First(conv).Error
+	if err == gorm.ErrRecordNotFound && len(params.args) > 0 {
+		err = query.Where("mother_id = ? AND thread_id = ?", mom.ID, params.args[0]).First(conv).Error
+		params.args = params.args[1:]
+	}
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			mom.log.Println(err)
+		}
+		return nil
+	}
+	return conv
+}
+
+// Files a ticket for the conversation in the thread the command was sent in, or the given threadID
+func cmdTicket(mom *Mother, params cmdParams) bool {
+	if mom.tickets == nil {
+		return false
+	}
+	conv := commandConversation(mom, &params)
+	if conv == nil {
+		return false
+	}
+	if conv.TicketID != "" {
+		mom.sendMessage(params.chanID, params.threadID, mom.getMsg("ticketExists", []langVar{
+			{"TICKET_ID", conv.TicketID},
+			{"TICKET_URL", conv.TicketURL},
+			{"TICKET_LINK", ticketLink(conv.TicketID, conv.TicketURL)},
+		}))
+		return true
+	}
+	if err := mom.fileTicket(conv, strings.Join(params.args, " "), params.userID); err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	mom.sendMessage(mom.config.ChanID, conv.ThreadID, mom.getMsg("ticketCreated", []langVar{
+		{"SLACK_ID", params.userID},
+		{"TICKET_ID", conv.TicketID},
+		{"TICKET_URL", conv.TicketURL},
+		{"TICKET_LINK", ticketLink(conv.TicketID, conv.TicketURL)},
+	}))
+	return true
+}
+
+// Emails a transcript of the conversation in the thread the command was sent in, or the given threadID, to the given
+// addresses or else the participants' profile addresses
+func cmdTranscript(mom *Mother, params cmdParams) bool {
+	if !mom.config.Email.enabled() {
+		return false
+	}
+	conv := commandConversation(mom, &params)
+	if conv == nil {
+		return false
+	}
+	var to []string
+	for _, arg := range params.args {
+		email, ok := parseEmail(mom, arg)
+		if !ok {
+			return false
+		}
+		to = append(to, email)
+	}
+	if err := mom.emailTranscript(conv.ID, to); err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	return true
+}
+
 // Loads bot with given name
 func cmdLoad(mom *Mother, params cmdParams) bool {
 	if len(params.args) == 0 {
@@ -541,28 +824,24 @@ func cmdLoad(mom *Mother, params cmdParams) bool {
 
 // Reloads bot with updated configuration
 func cmdReload(mom *Mother, _ cmdParams) bool {
-	path := filepath.Join("bot_config", mom.Name) + ".json"
-	configFile, err := os.Stat(path)
+	config, err := readConfig(mom.Name)
 	if err != nil {
 		mom.log.Println(err)
 		return false
 	}
-	go func(mom *Mother, configFile os.FileInfo) {
+	go func(mom *Mother, config botConfig) {
 		// Give a second for emoji response to send
 		time.Sleep(time.Second)
-		mom.reload = true
-		mom.rtm.Disconnect()
-		// Wait for bot to fully disconnect
-		<-mom.shutdown
-		// Need a little time to prevent new instance from picking up duplicate events
-		time.Sleep(time.Second * 5)
-		if loadBot(configFile) {
-			go mothers.Range(blacklistBots)
-		} else {
-			// Clean up disabled bot in the event of an error
-			mothers.Delete(mom.Name)
+		if _, err := reloadBot(mom, config); err != nil {
+			mom.log.Println(err)
+			// A disabled bot is shut down rather than kept running
+			if mom.isOnline() {
+				reportConfigChange(mom, "configReloadFailed", []langVar{
+					{"ERROR", err.Error()},
+				})
+			}
 		}
-	}(mom, configFile)
+	}(mom, config)
 	return true
 }
 
@@ -579,7 +858,7 @@ func cmdUnload(mom *Mother, params cmdParams) bool {
 		return false
 	}
 	toUnload := bot.(*Mother)
-	go toUnload.rtm.Disconnect()
+	go toUnload.disconnect()
 	return true
 }
 
@@ -590,26 +869,35 @@ func cmdUptime(mom *Mother, params cmdParams) bool {
 		name := key.(string)
 		bot := value.(*Mother)
 		// Can't tag bots located in different workspaces
-		var format string
-		if mom.rtm.GetInfo().Team.ID == bot.rtm.GetInfo().Team.ID {
-			format = "cmdUptimeElement"
-		} else {
+		// Templates can handle both in cmdUptimeElement with FOREIGN if cmdUptimeForeignElement is left empty
+		foreign := mom.info().Team.ID != bot.info().Team.ID
+		format := "cmdUptimeElement"
+		if foreign && mom.config.Lang["cmdUptimeForeignElement"] != "" {
 			format = "cmdUptimeForeignElement"
 		}
+		online := bot.isOnline()
+		standby := online && bot.isStandby()
 		var duration string
-		if bot.isOnline() {
+		if standby {
+			duration = mom.getMsg("cmdUptimeStandby", nil)
+		} else if online {
 			duration = time.Now().Sub(bot.connectedAt).Round(time.Second).String()
 		} else {
 			duration = mom.getMsg("cmdUptimeOffline", nil)
 		}
 		uptime = append(uptime, mom.getMsg(format, []langVar{
 			{"BOT_NAME", name},
-			{"BOT_SLACK_ID", bot.rtm.GetInfo().User.ID},
+			{"BOT_SLACK_ID", bot.info().User.ID},
 			{"UPTIME", duration},
+			{"ONLINE", online},
+			{"STANDBY", standby},
+			{"CONNECTED_AT", bot.connectedAt},
+			{"FOREIGN", foreign},
+			{"CRASHES", bot.crashCount()},
 		}))
 		return true
 	})
 	msg := strings.Join(uptime, "\n")
-	mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, params.chanID, slack.RTMsgOptionTS(params.threadID)))
+	mom.sendMessage(params.chanID, params.threadID, msg)
 	return true
 }
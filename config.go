@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type (
+	botConfig struct {
+		Token                  string
+		ChanID                 string
+		Enabled                bool
+		AllowCommandsInChannel bool
+		MaxFileSize            int
+		AllowedFileTypes       []string
+		DeniedFileTypes        []string
+		FileTypeMaxSize        map[string]int
+		SessionTimeout         int64
+		TimeoutCheckInterval   int64
+		ThreadsPerPage         int
+		StaffIdentity          string
+		StudentIdentity        string
+		TeamName               string
+		TeamIcon               string
+		StaffAllowedMentions   []string
+		StudentCommands        []string
+		Locale                 string
+		Lang                   map[string]string
+		Locales                map[string]map[string]string
+		Archive                archiveConfig
+		Email                  emailConfig
+		Tickets                ticketConfig
+		Webhooks               []webhookConfig
+		lang                   *langPack
+		locales                map[string]*langPack
+	}
+
+	// Where mirrored attachments are archived; Driver is "local", "s3", or empty to disable archiving
+	archiveConfig struct {
+		Driver        string
+		Path          string
+		Endpoint      string
+		Region        string
+		Bucket        string
+		AccessKey     string
+		SecretKey     string
+		RetentionDays int
+	}
+
+	// Lists every problem found while validating a configuration file
+	configError struct {
+		problems []string
+	}
+)
+
+var (
+	tokenRgx  = regexp.MustCompile("^xox[abps]-[0-9A-Za-z-]+$")
+	chanIDRgx = regexp.MustCompile("^[CG][0-9A-Z]{8,}$")
+)
+
+func (err *configError) Error() string {
+	return strings.Join(err.problems, "; ")
+}
+
+// Reads, parses, and validates the configuration file for the given bot name
+func readConfig(botName string) (botConfig, error) {
+	var config botConfig
+	path := filepath.Join("bot_config", botName+".json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		return config, &configError{problems: problems}
+	}
+	// Fill in anything the configuration file doesn't override with the built-in language pack
+	lang := make(map[string]string, len(defaultLang))
+	for key, value := range defaultLang {
+		lang[key] = value
+	}
+	for key, value := range config.Lang {
+		lang[key] = value
+	}
+	config.Lang = lang
+	if config.lang, err = newLangPack(lang); err != nil {
+		return config, err
+	}
+	// Locale packs fall back to the bot's own language pack for anything they don't override
+	config.locales = make(map[string]*langPack, len(config.Locales))
+	for locale, overrides := range config.Locales {
+		localeLang := make(map[string]string, len(lang))
+		for key, value := range lang {
+			localeLang[key] = value
+		}
+		for key, value := range overrides {
+			localeLang[key] = value
+		}
+		if config.locales[strings.ToLower(locale)], err = newLangPack(localeLang); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+func (config *botConfig) validate() []string {
+	var problems []string
+	if !tokenRgx.MatchString(config.Token) {
+		problems = append(problems, "Token is not a valid Slack token")
+	}
+	if !chanIDRgx.MatchString(config.ChanID) {
+		problems = append(problems, "ChanID is not a valid Slack channel ID")
+	}
+	if config.MaxFileSize <= 0 {
+		problems = append(problems, "MaxFileSize must be positive")
+	}
+	for fileType, size := range config.FileTypeMaxSize {
+		if size <= 0 {
+			problems = append(problems, fmt.Sprintf("FileTypeMaxSize for %q must be positive", fileType))
+		}
+	}
+	if config.SessionTimeout <= 0 {
+		problems = append(problems, "SessionTimeout must be positive")
+	}
+	if config.TimeoutCheckInterval <= 0 {
+		problems = append(problems, "TimeoutCheckInterval must be positive")
+	}
+	if config.ThreadsPerPage <= 0 {
+		problems = append(problems, "ThreadsPerPage must be positive")
+	}
+	switch config.StaffIdentity {
+	case "", identityTagged, identityIndividual:
+	case identityTeam:
+		if config.TeamName == "" {
+			problems = append(problems, "TeamName is required when StaffIdentity is \"team\"")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("StaffIdentity %q is not recognized", config.StaffIdentity))
+	}
+	switch config.StudentIdentity {
+	case "", identityTagged, identityIndividual:
+	default:
+		problems = append(problems, fmt.Sprintf("StudentIdentity %q is not recognized", config.StudentIdentity))
+	}
+	for _, mention := range config.StaffAllowedMentions {
+		if !isAllowed([]string{"here", "channel", "everyone", "subteam"}, mention) {
+			problems = append(problems, fmt.Sprintf("StaffAllowedMentions value %q is not recognized", mention))
+		}
+	}
+	for _, cmd := range config.StudentCommands {
+		if _, present := studentCommands[strings.ToLower(cmd)]; !present {
+			problems = append(problems, fmt.Sprintf("StudentCommands value %q is not recognized", cmd))
+		}
+	}
+	switch config.Archive.Driver {
+	case "":
+	case "local":
+		if config.Archive.Path == "" {
+			problems = append(problems, "Archive.Path is required for the local driver")
+		}
+	case "s3":
+		if config.Archive.Endpoint == "" || config.Archive.Bucket == "" {
+			problems = append(problems, "Archive.Endpoint and Archive.Bucket are required for the s3 driver")
+		}
+		if config.Archive.AccessKey == "" || config.Archive.SecretKey == "" {
+			problems = append(problems, "Archive.AccessKey and Archive.SecretKey are required for the s3 driver")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Archive.Driver %q is not recognized", config.Archive.Driver))
+	}
+	if config.Archive.RetentionDays < 0 {
+		problems = append(problems, "Archive.RetentionDays can not be negative")
+	}
+	problems = append(problems, config.Email.validate()...)
+	switch config.Tickets.Driver {
+	case "":
+	case "rest":
+		if !strings.HasPrefix(config.Tickets.URL, "https://") && !strings.HasPrefix(config.Tickets.URL, "http://") {
+			problems = append(problems, "Tickets.URL must be an http or https URL for the rest driver")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Tickets.Driver %q is not recognized", config.Tickets.Driver))
+	}
+	problems = append(problems, validateWebhooks(config.Webhooks)...)
+	problems = append(problems, validateLang("Lang", config.Lang)...)
+	locales := make([]string, 0, len(config.Locales))
+	for locale := range config.Locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	for _, locale := range locales {
+		if locale == "" || strings.EqualFold(locale, "default") {
+			problems = append(problems, fmt.Sprintf("Locales key %q is reserved", locale))
+			continue
+		}
+		problems = append(problems, validateLang("Locales."+locale, config.Locales[locale])...)
+	}
+	return problems
+}
+
+func validateLang(name string, lang map[string]string) []string {
+	var problems []string
+	keys := make([]string, 0, len(lang))
+	for key := range lang {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Unrecognized keys are most likely typos that would otherwise silently fall back to defaults
+		if _, present := defaultLang[key]; !present {
+			problems = append(problems, fmt.Sprintf("%s key %q is not recognized", name, key))
+			continue
+		}
+		if !isTemplate(lang[key]) {
+			continue
+		}
+		if _, err := parseLangTemplate(key, lang[key]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s key %q: %s", name, key, err))
+		}
+	}
+	return problems
+}
+
+// Returns the language pack best matching the given locale, e.g. "fr-CA" falls back to "fr", then to the default
+func (config *botConfig) localePack(locale string) *langPack {
+	locale = strings.ToLower(locale)
+	if locale == "" || strings.EqualFold(locale, config.Locale) {
+		return config.lang
+	}
+	if pack, present := config.locales[locale]; present {
+		return pack
+	}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if pack, present := config.locales[locale[:i]]; present {
+			return pack
+		}
+	}
+	return config.lang
+}
+
+// Reports problems in every configuration file in "./bot_config" without connecting; returns exit status
+func validateConfigs() int {
+	files, err := ioutil.ReadDir("bot_config")
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	status := 0
+	for _, configFile := range files {
+		botName, ok := configBotName(configFile)
+		if !ok {
+			continue
+		}
+		_, err := readConfig(botName)
+		if err == nil {
+			fmt.Printf("%s: OK\n", botName)
+			continue
+		}
+		status = 1
+		if cfgErr, ok := err.(*configError); ok {
+			for _, problem := range cfgErr.problems {
+				fmt.Printf("%s: %s\n", botName, problem)
+			}
+		} else {
+			fmt.Printf("%s: %s\n", botName, err)
+		}
+	}
+	return status
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -12,29 +12,68 @@ import (
 type (
 	Conversation struct {
 		gorm.Model
-		MotherID    uint
-		SlackIDs    string
-		DirectID    string
-		ThreadID    string
-		MessageLogs []MessageLog
-		Active      bool
+		MotherID     uint
+		SlackIDs     string
+		DirectID     string
+		ThreadID     string
+		MessageLogs  []MessageLog
+		Participants []ConversationParticipant
+		Active       bool
+		// Ticket filed for the conversation with !ticket, if any
+		TicketID    string
+		TicketURL   string
 		mom         *Mother           `gorm:"-"`
 		convIndex   map[string]string `gorm:"-"`
 		directIndex map[string]string `gorm:"-"`
 	}
+	ConversationParticipant struct {
+		gorm.Model
+		ConversationID uint
+		SlackID        string
+	}
 	MessageLog struct {
 		gorm.Model
 		ConversationID  uint
 		SlackID         string
 		Msg             string `gorm:"type:text"`
+		Raw             string `gorm:"type:mediumtext"`
 		DirectTimestamp string
 		ConvTimestamp   string
 		Original        bool
+		Attachments     []Attachment
+	}
+	// File attached to a relayed message; DirectURL and ConvURL are the file's URLs on either side
+	Attachment struct {
+		gorm.Model
+		MessageLogID uint
+		FileID       string
+		Name         string
+		Filetype     string
+		Size         int
+		DirectURL    string `gorm:"type:text"`
+		ConvURL      string `gorm:"type:text"`
+		Status       string
+		ArchiveHash  string
 	}
 )
 
+const (
+	attachmentMirrored = "mirrored"
+	attachmentTooLarge = "too_large"
+	attachmentFailed   = "failed"
+	attachmentRejected = "rejected"
+)
+
+// Lang keys describing each attachment status
+var attachmentStatusKeys = map[string]string{
+	attachmentMirrored: "attachmentMirrored",
+	attachmentTooLarge: "attachmentTooLarge",
+	attachmentFailed:   "attachmentFailed",
+	attachmentRejected: "attachmentRejected",
+}
+
 func (conv *Conversation) addLog(entry *MessageLog) {
-	entry.Msg = conv.mom.subDisplayNames(entry.Msg)
+	entry.Msg = conv.mom.resolveMarkup(entry.Msg)
 	err := db.
 		Model(conv).
 		Association("MessageLogs").
@@ -42,11 +81,39 @@ func (conv *Conversation) addLog(entry *MessageLog) {
 	if err != nil {
 		conv.mom.log.Println(err)
 	}
+	conv.mom.convMu.Lock()
 	conv.directIndex[entry.DirectTimestamp] = entry.ConvTimestamp
 	conv.convIndex[entry.ConvTimestamp] = entry.DirectTimestamp
+	conv.mom.convMu.Unlock()
 	conv.update()
+	conv.mom.publishLifecycle(webhookPayload{
+		Event:        webhookConversationMessage,
+		Conversation: conv.payload(),
+		Message: &messagePayload{
+			SlackID:         entry.SlackID,
+			Text:            entry.Msg,
+			DirectTimestamp: entry.DirectTimestamp,
+			ConvTimestamp:   entry.ConvTimestamp,
+			Original:        entry.Original,
+		},
+	})
+}
+
+// Returns the timestamp a message was relayed as on the other side of the conversation
+func (conv *Conversation) mirrorOf(timestamp string, isDirect bool) (string, bool) {
+	conv.mom.convMu.RLock()
+	defer conv.mom.convMu.RUnlock()
+	var mirror string
+	var present bool
+	if isDirect {
+		mirror, present = conv.directIndex[timestamp]
+	} else {
+		mirror, present = conv.convIndex[timestamp]
+	}
+	return mirror, present
 }
 
+// Callers must hold convMu
 func (conv *Conversation) hasLog(timestamp string) bool {
 	present := timestamp == conv.ThreadID
 	if !present {
@@ -58,42 +125,154 @@ func (conv *Conversation) hasLog(timestamp string) bool {
 	return present
 }
 
-func (conv *Conversation) postMessageToThread(msg string) (string, error) {
-	return conv.mom.postMessage(conv.mom.config.ChanID, conv.ThreadID, msg)
+func (conv *Conversation) postMessageToThread(msg string, options ...slack.MsgOption) (string, error) {
+	return conv.mom.postMessage(conv.mom.config.ChanID, conv.ThreadID, msg, options...)
+}
+
+func (conv *Conversation) postMessageToDM(msg string, options ...slack.MsgOption) (string, error) {
+	return conv.mom.postMessage(conv.DirectID, "", msg, options...)
+}
+
+// Relays a message to the thread; content carries blocks and attachments that should only follow the last chunk
+func (conv *Conversation) relayToThread(msg string, options, content []slack.MsgOption) (string, error) {
+	return conv.mom.postRichMessage(conv.mom.config.ChanID, conv.ThreadID, msg, options, content)
+}
+
+func (conv *Conversation) relayToDM(msg string, options, content []slack.MsgOption) (string, error) {
+	return conv.mom.postRichMessage(conv.DirectID, "", msg, options, content)
+}
+
+// Relays a message sent to the conversation's thread to the users
+func (conv *Conversation) relayFromThread(m *slack.Msg) error {
+	// Already relayed, i.e. by missed-message recovery
+	if _, present := conv.mirrorOf(m.Timestamp, false); present {
+		return nil
+	}
+	msg, options := conv.mom.formatRelay(m.User, m.Text, true)
+	directTimestamp, err := conv.relayToDM(msg, options, conv.mom.richContent(msg, m, true))
+	if err != nil {
+		return err
+	}
+	entry := &MessageLog{
+		SlackID:         m.User,
+		Msg:             m.Text,
+		Raw:             rawPayload(m),
+		DirectTimestamp: directTimestamp,
+		ConvTimestamp:   m.Timestamp,
+		Original:        true,
+	}
+	conv.addLog(entry)
+	conv.mirrorAttachments(m, entry, false)
+	return nil
+}
+
+// Relays a message sent by the users to the conversation's thread
+func (conv *Conversation) relayFromDM(m *slack.Msg) error {
+	if _, present := conv.mirrorOf(m.Timestamp, true); present {
+		return nil
+	}
+	msg, options := conv.mom.formatRelay(m.User, m.Text, false)
+	convTimestamp, err := conv.relayToThread(msg, options, conv.mom.richContent(msg, m, false))
+	if err != nil {
+		return err
+	}
+	entry := &MessageLog{
+		SlackID:         m.User,
+		Msg:             m.Text,
+		Raw:             rawPayload(m),
+		DirectTimestamp: m.Timestamp,
+		ConvTimestamp:   convTimestamp,
+		Original:        true,
+	}
+	conv.addLog(entry)
+	conv.mirrorAttachments(m, entry, true)
+	return nil
+}
+
+func (conv *Conversation) mirrorAttachments(m *slack.Msg, entry *MessageLog, isDirect bool) {
+	for _, attach := range m.Files {
+		if attach.URLPrivateDownload == "" {
+			continue
+		}
+		if err := conv.mirrorAttachment(attach, entry, isDirect); err != nil {
+			conv.mom.log.Println(err)
+		}
+	}
 }
 
-func (conv *Conversation) postMessageToDM(msg string) (string, error) {
-	return conv.mom.postMessage(conv.DirectID, "", msg)
+func (conv *Conversation) hasParticipant(slackID string) bool {
+	for _, p := range conv.Participants {
+		if p.SlackID == slackID {
+			return true
+		}
+	}
+	return false
+}
+
+func (conv *Conversation) participantIDs() []string {
+	slackIDs := make([]string, len(conv.Participants))
+	for i, p := range conv.Participants {
+		slackIDs[i] = p.SlackID
+	}
+	sort.Strings(slackIDs)
+	return slackIDs
+}
+
+// Returns the locale shared by every user in the conversation, or an empty string for the bot's default
+func (conv *Conversation) getLocale() string {
+	var locale string
+	for i, slackID := range conv.participantIDs() {
+		userLocale := conv.mom.getUserLocale(slackID)
+		if i > 0 && !strings.EqualFold(userLocale, locale) {
+			return ""
+		}
+		locale = userLocale
+	}
+	return locale
+}
+
+// Renders a message for the direct message side of the conversation in the users' locale
+func (conv *Conversation) getDirectMsg(key string, vars []langVar) string {
+	return conv.mom.getLocalMsg(conv.getLocale(), key, vars)
 }
 
 func (conv *Conversation) sendMessageToThread(msg string) {
-	conv.mom.rtm.SendMessage(
-		conv.mom.rtm.NewOutgoingMessage(
-			msg,
-			conv.mom.config.ChanID,
-			slack.RTMsgOptionTS(conv.ThreadID),
-		),
-	)
+	conv.mom.sendMessage(conv.mom.config.ChanID, conv.ThreadID, msg)
 }
 
 func (conv *Conversation) sendMessageToDM(msg string) {
-	conv.mom.rtm.SendMessage(conv.mom.rtm.NewOutgoingMessage(msg, conv.DirectID))
+	conv.mom.sendMessage(conv.DirectID, "", msg)
+}
+
+func (conv *Conversation) addAttachment(msgEntry *MessageLog, attach *Attachment) {
+	err := db.
+		Model(msgEntry).
+		Association("Attachments").
+		Append(attach).Error
+	if err != nil {
+		conv.mom.log.Println(err)
+	}
 }
 
 func (conv *Conversation) mirrorAttachment(file slack.File, msgEntry *MessageLog, isDirect bool) error {
-	buff := &bytes.Buffer{}
 	threadTimestamp := ""
-	if file.Size > conv.mom.config.MaxFileSize {
-		msg := conv.mom.getMsg("fileTooLarge", []langVar{
-			{"FILE_NAME", file.Name},
-			{"MAX_FILE_SIZE", strconv.Itoa(conv.mom.config.MaxFileSize)},
-		})
-		conv.sendMessageToDM(msg)
-		conv.sendMessageToThread(msg)
-		return nil
+	attach := &Attachment{
+		FileID:   file.ID,
+		Name:     file.Name,
+		Filetype: file.Filetype,
+		Size:     file.Size,
+		Status:   attachmentFailed,
 	}
-	if err := conv.mom.rtm.GetFile(file.URLPrivateDownload, buff); err != nil {
-		return err
+	if isDirect {
+		attach.DirectURL = file.URLPrivate
+	} else {
+		attach.ConvURL = file.URLPrivate
+	}
+	defer conv.addAttachment(msgEntry, attach)
+	policy := conv.mom.config.checkFilePolicy(file)
+	if !policy.allowed {
+		conv.rejectAttachment(file, attach, policy)
+		return nil
 	}
 	chanID := make([]string, 1)
 	if isDirect {
@@ -102,9 +281,10 @@ func (conv *Conversation) mirrorAttachment(file slack.File, msgEntry *MessageLog
 	} else {
 		chanID[0] = conv.DirectID
 	}
-	upload, err := conv.mom.rtm.UploadFile(
+	upload, hash, err := conv.relayFile(
+		file,
+		policy.maxSize,
 		slack.FileUploadParameters{
-			Reader:          buff,
 			Filetype:        file.Filetype,
 			Filename:        file.Name,
 			Title:           file.Title,
@@ -112,90 +292,110 @@ func (conv *Conversation) mirrorAttachment(file slack.File, msgEntry *MessageLog
 			ThreadTimestamp: threadTimestamp,
 		},
 	)
+	if err == ErrFileSizeExceeded {
+		// The file turned out larger than Slack reported
+		policy.reason = "fileTooLarge"
+		conv.rejectAttachment(file, attach, policy)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	var fileURL string
+	attach.ArchiveHash = hash
 	if isDirect {
-		fileURL = upload.URLPrivate
+		attach.ConvURL = upload.URLPrivate
 	} else {
-		fileURL = file.URLPrivate
+		attach.DirectURL = upload.URLPrivate
 	}
-	msg := conv.mom.getMsg("uploadedFile", []langVar{
-		{"FILE_URL", fileURL},
-	})
-	entry := &MessageLog{
-		SlackID:         file.User,
-		Msg:             msg,
-		DirectTimestamp: msgEntry.DirectTimestamp + "a",
-		ConvTimestamp:   msgEntry.ConvTimestamp + "a",
-		Original:        true,
-	}
-	conv.addLog(entry)
+	attach.Status = attachmentMirrored
 	return nil
 }
 
-func (conv *Conversation) mirrorEdit(slackID, timestamp, msg string, isDirect bool) {
-	var chanID, convTimestamp, directTimestamp, mirrorTimestamp string
+// Tells both sides why a file wasn't forwarded
+func (conv *Conversation) rejectAttachment(file slack.File, attach *Attachment, policy filePolicy) {
+	vars := []langVar{
+		{"FILE_NAME", file.Name},
+		{"FILE_TYPE", file.Filetype},
+		{"FILE_SIZE", file.Size},
+		{"MAX_FILE_SIZE", policy.maxSize},
+	}
+	conv.sendMessageToDM(conv.getDirectMsg(policy.reason, vars))
+	conv.sendMessageToThread(conv.mom.getMsg(policy.reason, vars))
+	if policy.reason == "fileTooLarge" {
+		attach.Status = attachmentTooLarge
+	} else {
+		attach.Status = attachmentRejected
+	}
+}
+
+func (conv *Conversation) mirrorEdit(edited *slack.Msg, isDirect bool) error {
+	slackID := edited.User
+	timestamp := edited.Timestamp
+	mirrorTimestamp, present := conv.mirrorOf(timestamp, isDirect)
+	if !present {
+		return nil
+	}
+	var chanID, convTimestamp, directTimestamp string
 	if isDirect {
-		if _, present := conv.directIndex[timestamp]; !present {
-			return
-		}
-		convTimestamp = conv.directIndex[timestamp]
+		convTimestamp = mirrorTimestamp
 		directTimestamp = timestamp
-		mirrorTimestamp = convTimestamp
 		chanID = conv.mom.config.ChanID
 	} else {
-		if _, present := conv.convIndex[timestamp]; !present {
-			return
-		}
 		convTimestamp = timestamp
-		directTimestamp = conv.convIndex[timestamp]
-		mirrorTimestamp = directTimestamp
+		directTimestamp = mirrorTimestamp
 		chanID = conv.DirectID
 	}
-	_, _, _, err := conv.mom.rtm.UpdateMessage(
-		chanID,
-		mirrorTimestamp,
-		slack.MsgOptionText(conv.mom.getMsg("msgCopyFmt", []langVar{
-			{"SLACK_ID", slackID},
-			{"MESSAGE", msg},
-		}), false),
+	// Usernames and icons can't be changed by an edit, so only the content is reformatted
+	relayed, _ := conv.mom.formatRelay(slackID, edited.Text, !isDirect)
+	// Edits can't be split across messages, so anything past the limit is cut off with a notice
+	marker := conv.mom.getMsg("editTruncated", nil)
+	if !isDirect {
+		marker = conv.getDirectMsg("editTruncated", nil)
+	}
+	relayed = truncateMessage(relayed, postMessageLimit, marker)
+	options := append(
+		[]slack.MsgOption{slack.MsgOptionText(relayed, false)},
+		conv.mom.richContent(relayed, edited, !isDirect)...,
 	)
+	_, _, _, err := conv.mom.rtm.UpdateMessage(chanID, mirrorTimestamp, options...)
 	if err != nil {
-		conv.mom.log.Println(err)
-		return
+		return err
 	}
 	entry := &MessageLog{
 		ConversationID:  conv.ID,
 		SlackID:         slackID,
-		Msg:             msg,
+		Msg:             edited.Text,
+		Raw:             rawPayload(edited),
 		DirectTimestamp: directTimestamp,
 		ConvTimestamp:   convTimestamp,
 		Original:        false,
 	}
 	conv.addLog(entry)
+	return nil
 }
 
-func (conv *Conversation) mirrorReaction(timestamp, emoji string, isDirect, removed bool) {
+func (conv *Conversation) mirrorReaction(timestamp, emoji string, isDirect, removed bool) error {
+	mirrorTimestamp, present := conv.mirrorOf(timestamp, isDirect)
+	if !present {
+		return nil
+	}
 	var targetRef slack.ItemRef
 	if isDirect {
-		if _, present := conv.directIndex[timestamp]; !present {
-			return
-		}
-		targetRef = slack.NewRefToMessage(conv.mom.config.ChanID, conv.directIndex[timestamp])
+		targetRef = slack.NewRefToMessage(conv.mom.config.ChanID, mirrorTimestamp)
 	} else {
-		if _, present := conv.convIndex[timestamp]; !present {
-			return
-		}
-		targetRef = slack.NewRefToMessage(conv.DirectID, conv.convIndex[timestamp])
+		targetRef = slack.NewRefToMessage(conv.DirectID, mirrorTimestamp)
 	}
+	var err error
 	if removed {
-		_ = conv.mom.rtm.RemoveReaction(emoji, targetRef)
+		err = conv.mom.rtm.RemoveReaction(emoji, targetRef)
 	} else {
-		_ = conv.mom.rtm.AddReaction(emoji, targetRef)
+		err = conv.mom.rtm.AddReaction(emoji, targetRef)
+	}
+	if err != nil {
+		return err
 	}
 	conv.update()
+	return nil
 }
 
 func (conv *Conversation) init(mom *Mother) {
@@ -210,10 +410,13 @@ func (conv *Conversation) init(mom *Mother) {
 }
 
 func (conv *Conversation) setActive(state bool) error {
+	conv.mom.convMu.Lock()
+	defer conv.mom.convMu.Unlock()
 	var err error
 	if conv.Active != state {
 		err = db.
-			Model(conv).
+			Table("conversations").
+			Where("id = ?", conv.ID).
 			UpdateColumn("active", state).Error
 		conv.Active = state
 	}
@@ -221,15 +424,10 @@ func (conv *Conversation) setActive(state bool) error {
 }
 
 func (conv *Conversation) abandon() {
-	for i, c := range conv.mom.Conversations {
-		if c.ThreadID != conv.ThreadID {
-			continue
-		}
-		conv.mom.Conversations = append(conv.mom.Conversations[:i], conv.mom.Conversations[i+1:]...)
+	if conv.mom.untrackConversation(conv) {
 		if err := conv.setActive(false); err != nil {
 			conv.mom.log.Println(err)
 		}
-		break
 	}
 	if _, _, err := conv.mom.rtm.DeleteMessage(conv.mom.config.ChanID, conv.ThreadID); err != nil {
 		// In the worst case, this could result in an ugly situation where channel members are unknowingly sending
@@ -243,7 +441,15 @@ func (conv *Conversation) expire() {
 	if err := conv.setActive(false); err != nil {
 		conv.mom.log.Println(err)
 	}
-	conv.sendMessageToDM(conv.mom.getMsg("sessionExpiredDirect", nil))
+	conv.mom.publishLifecycle(webhookPayload{Event: webhookConversationExpired, Conversation: conv.payload()})
+	if conv.mom.config.Email.enabled() && conv.mom.config.Email.SendOnExpire {
+		go func(mom *Mother, convID uint) {
+			if err := mom.emailTranscript(convID, nil); err != nil {
+				mom.log.Println(err)
+			}
+		}(conv.mom, conv.ID)
+	}
+	conv.sendMessageToDM(conv.getDirectMsg("sessionExpiredDirect", nil))
 	conv.sendMessageToThread(conv.mom.getMsg("sessionExpiredConv", []langVar{
 		{"THREAD_ID", conv.ThreadID},
 	}))
@@ -252,13 +458,22 @@ func (conv *Conversation) expire() {
 func (conv *Conversation) update() {
 	now := time.Now()
 	err := db.
-		Model(conv).
-		Update("updated_at", now).Error
+		Table("conversations").
+		Where("id = ?", conv.ID).
+		UpdateColumn("updated_at", now).Error
 	if err != nil {
 		conv.mom.log.Println(err)
 	}
+	conv.mom.convMu.Lock()
 	conv.UpdatedAt = now
+	conv.mom.convMu.Unlock()
 	if err = conv.setActive(true); err != nil {
 		conv.mom.log.Println(err)
 	}
 }
+
+func (conv *Conversation) lastUpdated() time.Time {
+	conv.mom.convMu.RLock()
+	defer conv.mom.convMu.RUnlock()
+	return conv.UpdatedAt
+}
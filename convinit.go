@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"sort"
 	"strings"
 
@@ -37,25 +36,23 @@ func (ctx *convInitContext) postNewThread(directID string, slackIDs []string) *c
 	}
 	if ctx.resumed {
 		directID = ctx.conv.DirectID
-		slackIDs = strings.Split(ctx.conv.SlackIDs, ",")
+		slackIDs = ctx.conv.participantIDs()
 	} else {
 		sort.Strings(slackIDs)
 	}
-	tagged := make([]string, 0)
-	for _, ID := range slackIDs {
-		tagged = append(tagged, fmt.Sprintf("<@%s>", ID))
-	}
 	var threadID string
 	var err error
 	if ctx.initiator != "" {
 		parent := ctx.mom.getMsg("sessionNoticeCmd", []langVar{
 			{"INITIATOR", ctx.initiator},
-			{"USERS", strings.Join(tagged, ", ")},
+			{"USERS", mentions(slackIDs)},
+			{"USER_IDS", slackIDs},
 		})
 		threadID, err = ctx.mom.postMessage(ctx.mom.config.ChanID, "", parent)
 	} else {
 		parent := ctx.mom.getMsg("sessionNotice", []langVar{
-			{"USERS", strings.Join(tagged, ", ")},
+			{"USERS", mentions(slackIDs)},
+			{"USER_IDS", slackIDs},
 		})
 		threadID, err = ctx.mom.postMessage(ctx.mom.config.ChanID, "", parent)
 	}
@@ -63,11 +60,16 @@ func (ctx *convInitContext) postNewThread(directID string, slackIDs []string) *c
 		ctx.err = err
 		return ctx
 	}
+	participants := make([]ConversationParticipant, len(slackIDs))
+	for i, ID := range slackIDs {
+		participants[i] = ConversationParticipant{SlackID: ID}
+	}
 	ctx.conv = &Conversation{
-		MotherID: ctx.mom.ID,
-		SlackIDs: strings.Join(slackIDs, ","),
-		DirectID: directID,
-		ThreadID: threadID,
+		MotherID:     ctx.mom.ID,
+		SlackIDs:     strings.Join(slackIDs, ","),
+		DirectID:     directID,
+		ThreadID:     threadID,
+		Participants: participants,
 	}
 	ctx.conv.init(ctx.mom)
 	ctx.newThread = true
@@ -82,13 +84,15 @@ func (ctx *convInitContext) loadConversation(threadID string) *convInitContext {
 	err := db.
 		Where("mother_id = ? AND thread_id = ?", ctx.mom.ID, threadID).
 		Preload("MessageLogs").
+		Preload("MessageLogs.Attachments").
+		Preload("Participants").
 		First(conv).Error
 	if err != nil {
 		ctx.err = err
 		return ctx
 	}
 	ctx.conv = conv
-	for _, slackID := range strings.Split(conv.SlackIDs, ",") {
+	for _, slackID := range conv.participantIDs() {
 		// Prevent reactivating conversations with channel members or blacklisted users
 		if ctx.mom.hasMember(slackID) || ctx.mom.isBlacklisted(slackID) {
 			ctx.err = ErrUserNotAllowed
@@ -116,16 +120,14 @@ func findPreviousConv(ctx *convInitContext) {
 	if ctx.err != nil {
 		return
 	}
-	for _, prev := range ctx.mom.Conversations {
-		if prev.Active && prev.DirectID == ctx.conv.DirectID {
-			ctx.prev = &prev
-			ctx.switched = true
-			return
-		}
+	if prev := ctx.mom.findConversationByChannel(ctx.conv.DirectID); prev != nil {
+		ctx.prev = prev
+		ctx.switched = true
+		return
 	}
 	prev := &Conversation{mom: ctx.mom}
-	err := db.
-		Where("mother_id = ? AND slack_ids = ?", ctx.mom.ID, ctx.conv.SlackIDs).
+	err := ctx.mom.
+		conversationsWithUsers(ctx.conv.participantIDs(), false).
 		Order("updated_at desc, id desc").
 		First(prev).Error
 	if err != nil {
@@ -142,7 +144,7 @@ func newThreadNotice(ctx *convInitContext) {
 		{"THREAD_ID", ctx.conv.ThreadID},
 	}))
 	if !ctx.resumed && !ctx.switched {
-		ctx.conv.sendMessageToDM(ctx.mom.getMsg("sessionStartDirect", nil))
+		ctx.conv.sendMessageToDM(ctx.conv.getDirectMsg("sessionStartDirect", nil))
 		if ctx.prev != nil {
 			ctx.msg = append(ctx.msg, ctx.mom.getMsg("sessionStartPrev", []langVar{
 				{"THREAD_LINK", ctx.mom.getMessageLink(ctx.prev.ThreadID)},
@@ -165,7 +167,7 @@ func resumeNotice(ctx *convInitContext) {
 		}))
 	}
 	if !ctx.switched {
-		ctx.conv.sendMessageToDM(ctx.mom.getMsg("sessionResumeDirect", nil))
+		ctx.conv.sendMessageToDM(ctx.conv.getDirectMsg("sessionResumeDirect", nil))
 		// For conversations resumed with a message
 		if !ctx.newThread {
 			ctx.msg = append(ctx.msg, ctx.mom.getMsg("sessionResumeConv", nil))
@@ -175,15 +177,10 @@ func resumeNotice(ctx *convInitContext) {
 
 func switchContext(ctx *convInitContext) {
 	// Remove previous context from tracked conversations
-	for i, prev := range ctx.mom.Conversations {
-		if prev.ThreadID != ctx.prev.ThreadID {
-			continue
-		}
-		ctx.mom.Conversations = append(ctx.mom.Conversations[:i], ctx.mom.Conversations[i+1:]...)
+	if ctx.mom.untrackConversation(ctx.prev) {
 		if err := ctx.prev.setActive(false); err != nil {
 			ctx.mom.log.Println(err)
 		}
-		break
 	}
 	if (ctx.resumed && !ctx.newThread) || !ctx.resumed {
 		ctx.prev.sendMessageToThread(ctx.mom.getMsg("sessionContextSwitchedTo", []langVar{
@@ -196,11 +193,14 @@ func switchContext(ctx *convInitContext) {
 }
 
 func (ctx *convInitContext) create() (*Conversation, error) {
+	// Another worker could otherwise create a conversation for the same users at the same time
+	ctx.mom.initMu.Lock()
+	defer ctx.mom.initMu.Unlock()
 	if findPreviousConv(ctx); ctx.err == nil {
-		ctx.err = db.
-			Model(ctx.mom).
-			Association("Conversations").
-			Append(ctx.conv).Error
+		ctx.conv.MotherID = ctx.mom.ID
+		if ctx.err = db.Save(ctx.conv).Error; ctx.err == nil {
+			ctx.mom.trackConversation(ctx.conv)
+		}
 	}
 	if ctx.err != nil {
 		if ctx.newThread {
@@ -217,8 +217,25 @@ func (ctx *convInitContext) create() (*Conversation, error) {
 	if ctx.switched {
 		switchContext(ctx)
 	}
+	ctx.publish()
 	if _, err := ctx.conv.postMessageToThread(strings.Join(ctx.msg, "\n")); err != nil {
 		ctx.mom.log.Println(err)
 	}
 	return ctx.conv, nil
 }
+
+// Reports the new conversation to webhooks, along with the one it replaced if the context switched
+func (ctx *convInitContext) publish() {
+	event := webhookConversationStarted
+	if ctx.resumed {
+		event = webhookConversationResumed
+	}
+	ctx.mom.publishLifecycle(webhookPayload{Event: event, Conversation: ctx.conv.payload()})
+	if ctx.switched {
+		ctx.mom.publishLifecycle(webhookPayload{
+			Event:        webhookConversationSwitched,
+			Conversation: ctx.conv.payload(),
+			Previous:     ctx.prev.payload(),
+		})
+	}
+}
@@ -19,12 +19,6 @@ func openConnection() {
 	); err == nil {
 		db.DB().SetConnMaxLifetime(time.Minute * 15)
 		db.DB().SetMaxIdleConns(0)
-		err = db.AutoMigrate(
-			&BlacklistedUser{},
-			&Conversation{},
-			&MessageLog{},
-			&Mother{},
-		).Error
 	}
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+)
+
+// Record of an event that has already been acted on, kept for the session window so that redelivered events are
+// ignored, even by a reloaded instance of the bot
+type ProcessedEvent struct {
+	ID        uint `gorm:"primary_key"`
+	MotherID  uint
+	EventKey  string
+	CreatedAt time.Time
+}
+
+// Keys events by channel and message timestamp; kind separates different actions on the same message
+func eventKey(chanID, timestamp, kind string) string {
+	key := chanID + ":" + timestamp
+	if kind != "" {
+		key += ":" + kind
+	}
+	return key
+}
+
+// Returns true if the event hasn't been handled yet and marks it as handled
+func (mom *Mother) claimEvent(key string) bool {
+	mom.cacheMu.Lock()
+	_, present := mom.processed[key]
+	if !present {
+		mom.processed[key] = expirable{updatedAt: time.Now()}
+	}
+	mom.cacheMu.Unlock()
+	if present {
+		return false
+	}
+	entry := &ProcessedEvent{MotherID: mom.ID, EventKey: key}
+	if err := db.Create(entry).Error; err != nil {
+		// Unique index on the key rejects events another instance has already claimed
+		var count int
+		db.Model(&ProcessedEvent{}).Where("mother_id = ? AND event_key = ?", mom.ID, key).Count(&count)
+		if count > 0 {
+			return false
+		}
+		// Better to risk a duplicate than to drop the event
+		mom.log.Println(err)
+	}
+	return true
+}
+
+// Forgets that an event was claimed, so that it's handled again if redelivered or recovered
+func (mom *Mother) releaseEvent(key string) {
+	mom.cacheMu.Lock()
+	delete(mom.processed, key)
+	mom.cacheMu.Unlock()
+	err := db.
+		Where("mother_id = ? AND event_key = ?", mom.ID, key).
+		Delete(&ProcessedEvent{}).Error
+	if err != nil {
+		mom.log.Println(err)
+	}
+}
+
+// Handles an event unless it was already handled; the claim is released if handle fails or panics, so the event
+// isn't lost
+func (mom *Mother) handleOnce(key string, handle func() error) {
+	if !mom.claimEvent(key) {
+		return
+	}
+	handled := false
+	defer func() {
+		if !handled {
+			mom.releaseEvent(key)
+		}
+	}()
+	if err := handle(); err != nil {
+		mom.log.Println(err)
+		return
+	}
+	handled = true
+}
+
+// Forgets events older than the session window
+func (mom *Mother) pruneProcessed() {
+	mom.pruneExpired(mom.processed)
+	threshold := time.Now().Add(-(time.Duration(mom.config.SessionTimeout) * time.Second))
+	err := db.
+		Where("mother_id = ? AND created_at < ?", mom.ID, threshold).
+		Delete(&ProcessedEvent{}).Error
+	if err != nil {
+		mom.log.Println(err)
+	}
+}
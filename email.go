@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP server transcripts are emailed through; emailing is disabled without a Host. Authentication is skipped when
+// Username is empty, e.g. for a local relay or sink.
+type emailConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// Emails every participant a transcript when their session expires
+	SendOnExpire bool
+}
+
+const emailTimeFormat = "Monday, January 2, 2006 at 3:04 PM MST"
+
+var ErrNoRecipients = errors.New("no recipients for transcript")
+
+func (config *emailConfig) enabled() bool {
+	return config.Host != ""
+}
+
+func (config *emailConfig) validate() []string {
+	var problems []string
+	if !config.enabled() {
+		return problems
+	}
+	if config.Port <= 0 || config.Port > 65535 {
+		problems = append(problems, "Email.Port must be a valid port number")
+	}
+	if _, err := mail.ParseAddress(config.From); err != nil {
+		problems = append(problems, "Email.From must be a valid email address")
+	}
+	return problems
+}
+
+// Parses an address given as a command argument, which Slack sends as a mailto link
+func parseEmail(mom *Mother, arg string) (string, bool) {
+	addr, err := mail.ParseAddress(mom.decodeMarkup(arg))
+	if err != nil {
+		return "", false
+	}
+	return addr.Address, true
+}
+
+// Returns the email addresses on the Slack profiles of the conversation's participants
+func (conv *Conversation) participantEmails() []string {
+	var emails []string
+	for _, slackID := range conv.participantIDs() {
+		user, err := conv.mom.getUserInfo(slackID)
+		if err != nil {
+			conv.mom.log.Println(err)
+			continue
+		}
+		if user.Profile.Email != "" {
+			emails = append(emails, user.Profile.Email)
+		}
+	}
+	return emails
+}
+
+// Emails a transcript of the conversation to the given addresses, or its participants' if none are given
+func (mom *Mother) emailTranscript(convID uint, to []string) error {
+	conv := &Conversation{mom: mom}
+	err := db.
+		Preload("MessageLogs").
+		Preload("MessageLogs.Attachments").
+		Preload("Participants").
+		First(conv, convID).Error
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		to = conv.participantEmails()
+	}
+	if len(to) == 0 {
+		return ErrNoRecipients
+	}
+	return mom.sendTranscript(conv, to)
+}
+
+// Emails a transcript of a loaded conversation; it's written for students, who may be among the recipients
+func (mom *Mother) sendTranscript(conv *Conversation, to []string) error {
+	buff := &bytes.Buffer{}
+	if err := writeStudentLogs(mom, buff, conv); err != nil {
+		return err
+	}
+	vars := transcriptVars(mom.Name, conv, buff.String())
+	locale := conv.getLocale()
+	subject := mom.getLocalMsg(locale, "transcriptSubject", vars)
+	body := mom.getLocalMsg(locale, "transcriptBody", vars)
+	return mom.sendEmail(to, subject, body)
+}
+
+// Times are formatted for readers rather than left in Go's default format; templates can format STARTED_TIME and
+// UPDATED_TIME themselves
+func transcriptVars(botName string, conv *Conversation, transcript string) []langVar {
+	return []langVar{
+		{"BOT_NAME", botName},
+		{"THREAD_ID", conv.ThreadID},
+		{"STARTED_AT", conv.CreatedAt.Format(emailTimeFormat)},
+		{"STARTED_TIME", conv.CreatedAt},
+		{"UPDATED_AT", conv.UpdatedAt.Format(emailTimeFormat)},
+		{"UPDATED_TIME", conv.UpdatedAt},
+		{"TRANSCRIPT", transcript},
+	}
+}
+
+// Sends a plain text email through the configured SMTP server
+func (mom *Mother) sendEmail(to []string, subject, body string) error {
+	config := mom.config.Email
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	writer := quotedprintable.NewWriter(msg)
+	if _, err := writer.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	return smtp.SendMail(addr, auth, from.Address, to, msg.Bytes())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Received by smtpSink
+type sunkEmail struct {
+	from string
+	to   []string
+	data string
+}
+
+// Accepts a single email on a local port without authentication, like a development mail sink
+func smtpSink(t *testing.T) (host string, port int, received <-chan sunkEmail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails := make(chan sunkEmail, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		var email sunkEmail
+		reply("220 sink ready")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+			switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				reply("250 sink")
+			case "MAIL":
+				email.from = strings.Trim(strings.TrimPrefix(cmd[len("MAIL "):], "FROM:"), "<>")
+				reply("250 ok")
+			case "RCPT":
+				email.to = append(email.to, strings.Trim(strings.TrimPrefix(cmd[len("RCPT "):], "TO:"), "<>"))
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				data := &strings.Builder{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				email.data = data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				emails <- email
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, emails
+}
+
+func TestSendEmail(t *testing.T) {
+	host, port, received := smtpSink(t)
+	mom := &Mother{
+		config: botConfig{Email: emailConfig{Host: host, Port: port, From: "RA Team <ra-team@example.com>"}},
+		log:    log.New(ioutil.Discard, "", 0),
+	}
+	to := []string{"student@example.com", "other@example.com"}
+	subject := "Transcript — session résumé"
+	body := "Line one with café\nA line that is long enough to be wrapped by the quoted-printable encoding used for it"
+	if err := mom.sendEmail(to, subject, body); err != nil {
+		t.Fatal(err)
+	}
+	var email sunkEmail
+	select {
+	case email = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+	}
+	if email.from != "ra-team@example.com" {
+		t.Errorf("MAIL FROM = %q, want %q", email.from, "ra-team@example.com")
+	}
+	if strings.Join(email.to, ",") != strings.Join(to, ",") {
+		t.Errorf("RCPT TO = %v, want %v", email.to, to)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(email.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("To"); got != strings.Join(to, ", ") {
+		t.Errorf("To = %q, want %q", got, strings.Join(to, ", "))
+	}
+	rawSubject := msg.Header.Get("Subject")
+	if !strings.HasPrefix(rawSubject, "=?utf-8?q?") {
+		t.Errorf("Subject %q is not Q-encoded", rawSubject)
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(rawSubject); err != nil || decoded != subject {
+		t.Errorf("Subject decodes to %q (%v), want %q", decoded, err, subject)
+	}
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q, want quoted-printable", got)
+	}
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SMTP ends the data with a line break of its own
+	got := strings.TrimSuffix(strings.Replace(string(decoded), "\r\n", "\n", -1), "\n")
+	if got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestTranscriptVarsFormatTimes(t *testing.T) {
+	started := time.Date(2019, time.March, 4, 15, 30, 0, 0, time.UTC)
+	conv := &Conversation{ThreadID: "1551713400.000100"}
+	conv.CreatedAt = started
+	conv.UpdatedAt = started.Add(time.Hour)
+	body, err := defaultLangPack.render("transcriptBody", transcriptVars("sample", conv, "[log]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "which started " + started.Format(emailTimeFormat) + "."
+	if !strings.Contains(body, want) {
+		t.Errorf("transcriptBody = %q, want it to contain %q", body, want)
+	}
+	if strings.Contains(body, strconv.Itoa(started.Year())+"-") {
+		t.Errorf("transcriptBody = %q contains an unformatted time", body)
+	}
+}
+
+func TestSendTranscriptHidesStaff(t *testing.T) {
+	host, port, received := smtpSink(t)
+	mom, conv := teamPersonaFixture()
+	mom.Name = "sample"
+	mom.config.Email = emailConfig{Host: host, Port: port, From: "RA Team <ra-team@example.com>"}
+	if err := mom.sendTranscript(conv, []string{"student@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	var email sunkEmail
+	select {
+	case email = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(email.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStaffHidden(t, subject+"\n"+string(body))
+	if !strings.Contains(string(body), "RA Team: Yes, how can we help?") {
+		t.Errorf("transcript doesn't attribute staff messages to the team:\n%s", body)
+	}
+}
@@ -7,19 +7,8 @@ import (
 	"github.com/nlopes/slack"
 )
 
-type (
-	blacklistEvent struct {
-		Type    string
-		SlackID string
-	}
-
-	scrubEvent struct {
-		Type string
-	}
-)
-
 // Handles messages sent to the member channel
-func handleChannelMessageEvent(mom *Mother, ev *slack.MessageEvent, sender *slack.User) {
+func handleChannelMessageEvent(mom *Mother, ev *slack.MessageEvent, sender *slack.User) error {
 	var conv *Conversation
 	if ev.ThreadTimestamp != "" {
 		conv = mom.findConversationByTimestamp(ev.ThreadTimestamp, true)
@@ -28,46 +17,22 @@ func handleChannelMessageEvent(mom *Mother, ev *slack.MessageEvent, sender *slac
 		if mom.config.AllowCommandsInChannel && ev.Text != "" && ev.Text[0] == '!' {
 			mom.runCommand(ev, sender, true)
 		}
-		return
-	}
-	msg := mom.getMsg("msgCopyFmt", []langVar{
-		{"SLACK_ID", ev.User},
-		{"MESSAGE", ev.Text},
-	})
-	directTimestamp, err := conv.postMessageToDM(msg)
-	if err != nil {
-		mom.log.Println(err)
-		return
-	}
-	entry := &MessageLog{
-		SlackID:         ev.User,
-		Msg:             ev.Text,
-		DirectTimestamp: directTimestamp,
-		ConvTimestamp:   ev.Timestamp,
-		Original:        true,
-	}
-	conv.addLog(entry)
-	for _, attach := range ev.Files {
-		if attach.URLPrivateDownload == "" {
-			continue
-		}
-		if err := conv.mirrorAttachment(attach, entry, false); err != nil {
-			mom.log.Println(err)
-		}
+		return nil
 	}
+	return conv.relayFromThread(&ev.Msg)
 }
 
 // Handles messages sent directly to the bot
-func handleDirectMessageEvent(mom *Mother, ev *slack.MessageEvent, sender *slack.User, chanInfo *slack.Channel) {
+func handleDirectMessageEvent(mom *Mother, ev *slack.MessageEvent, sender *slack.User, chanInfo *slack.Channel) error {
 	hasMember := false
 	// Cannot do anything with blacklisted user present
 	for _, userID := range chanInfo.Members {
 		if mom.isBlacklisted(userID) {
-			msg := mom.getMsg("blacklistedUser", []langVar{
+			msg := mom.getLocalMsg(mom.getUserLocale(sender.ID), "blacklistedUser", []langVar{
 				{"SLACK_ID", userID},
 			})
-			mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, ev.Channel))
-			return
+			mom.sendMessage(ev.Channel, "", msg)
+			return nil
 		}
 		if mom.hasMember(userID) {
 			hasMember = true
@@ -76,70 +41,45 @@ func handleDirectMessageEvent(mom *Mother, ev *slack.MessageEvent, sender *slack
 	// Accept commands from channel members or workspace admins
 	if ev.Text != "" && ev.Text[0] == '!' && (sender.IsAdmin || mom.hasMember(sender.ID)) {
 		mom.runCommand(ev, sender, false)
-		return
+		return nil
 	}
 	// Conversations cannot be held if a channel member is present
 	if hasMember {
 		memberChanInfo, err := mom.getChannelInfo(mom.config.ChanID)
 		if err != nil {
-			mom.log.Println(err)
-			return
+			return err
 		}
-		msg := mom.getMsg("inConvChannel", []langVar{
+		msg := mom.getLocalMsg(mom.getUserLocale(sender.ID), "inConvChannel", []langVar{
 			{"CHANNEL_NAME", memberChanInfo.Name},
 		})
-		mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(msg, ev.Channel))
-		return
+		mom.sendMessage(ev.Channel, "", msg)
+		return nil
+	}
+	// Student commands enabled for this bot are handled rather than relayed
+	if mom.isStudentCommand(ev.Text) {
+		mom.runStudentCommand(ev, sender)
+		return nil
 	}
-	var convTimestamp string
-	var err error
 	conv := mom.findConversationByChannel(ev.Channel)
 	if conv == nil {
+		var err error
 		conv, err = mom.
 			newConversation().
 			postNewThread(ev.Channel, chanInfo.Members).
 			create()
 		if err != nil {
-			mom.log.Println(err)
-			return
-		}
-	}
-	msg := mom.getMsg("msgCopyFmt", []langVar{
-		{"SLACK_ID", ev.User},
-		{"MESSAGE", ev.Text},
-	})
-	if convTimestamp, err = conv.postMessageToThread(msg); err != nil {
-		mom.log.Println(err)
-		return
-	}
-	entry := &MessageLog{
-		SlackID:         ev.User,
-		Msg:             ev.Text,
-		DirectTimestamp: ev.Timestamp,
-		ConvTimestamp:   convTimestamp,
-		Original:        true,
-	}
-	conv.addLog(entry)
-	for _, attach := range ev.Files {
-		if attach.URLPrivateDownload == "" {
-			continue
-		}
-		if err := conv.mirrorAttachment(attach, entry, true); err != nil {
-			mom.log.Println(err)
+			return err
 		}
 	}
+	return conv.relayFromDM(&ev.Msg)
 }
 
 // Forward edits of active conversation's messages between direct messages and conversation threads
-func handleMessageChangedEvent(mom *Mother, ev *slack.MessageEvent, chanInfo *slack.Channel) {
+func handleMessageChangedEvent(mom *Mother, ev *slack.MessageEvent, chanInfo *slack.Channel) error {
 	if conv := mom.findConversationByTimestamp(ev.SubMessage.Timestamp, false); conv != nil {
-		conv.mirrorEdit(
-			ev.SubMessage.User,
-			ev.SubMessage.Timestamp,
-			ev.SubMessage.Text,
-			chanInfo.IsIM || chanInfo.IsMpIM,
-		)
+		return conv.mirrorEdit(ev.SubMessage, chanInfo.IsIM || chanInfo.IsMpIM)
 	}
+	return nil
 }
 
 func handleMessageEvent(mom *Mother, ev *slack.MessageEvent) {
@@ -166,13 +106,17 @@ func handleMessageEvent(mom *Mother, ev *slack.MessageEvent) {
 		mom.log.Println(err)
 		return
 	}
-	if edit {
-		handleMessageChangedEvent(mom, ev, chanInfo)
-	} else if ev.Channel == mom.config.ChanID {
-		handleChannelMessageEvent(mom, ev, sender)
-	} else if chanInfo.IsIM || chanInfo.IsMpIM {
-		handleDirectMessageEvent(mom, ev, sender, chanInfo)
-	}
+	// Edits arrive with a timestamp of their own, so they're covered too
+	mom.handleOnce(eventKey(ev.Channel, ev.Timestamp, ""), func() error {
+		if edit {
+			return handleMessageChangedEvent(mom, ev, chanInfo)
+		} else if ev.Channel == mom.config.ChanID {
+			return handleChannelMessageEvent(mom, ev, sender)
+		} else if chanInfo.IsIM || chanInfo.IsMpIM {
+			return handleDirectMessageEvent(mom, ev, sender, chanInfo)
+		}
+		return nil
+	})
 }
 
 // Leave random public channels that bot gets invited into
@@ -201,7 +145,7 @@ func handleMemberJoinedChannelEvent(mom *Mother, ev *slack.MemberJoinedChannelEv
 		return
 	}
 	// Prevent users from being accidentally invited to the member channel; requires admin privileges
-	if botInfo, err := mom.getUserInfo(mom.rtm.GetInfo().User.ID); err == nil {
+	if botInfo, err := mom.getUserInfo(mom.info().User.ID); err == nil {
 		if botInfo.IsAdmin {
 			if !mom.isInvited(ev.User) {
 				if err := mom.rtm.KickUserFromConversation(ev.Channel, ev.User); err != nil {
@@ -216,15 +160,20 @@ func handleMemberJoinedChannelEvent(mom *Mother, ev *slack.MemberJoinedChannelEv
 		mom.log.Println(err)
 		return
 	}
-	chanInfo, err := mom.getChannelInfo(ev.Channel)
-	if err != nil {
+	if _, err := mom.getChannelInfo(ev.Channel); err != nil {
 		mom.log.Println(err)
 		return
 	}
-	if !mom.hasMember(ev.User) {
-		chanInfo.Members = append(chanInfo.Members, ev.User)
-		sort.Strings(chanInfo.Members)
-	}
+	mom.updateMembers(ev.Channel, func(members []string) []string {
+		for _, member := range members {
+			if member == ev.User {
+				return members
+			}
+		}
+		members = append(members, ev.User)
+		sort.Strings(members)
+		return members
+	})
 	mom.deactivateConversations(ev.User)
 }
 
@@ -233,17 +182,18 @@ func handleMemberLeftChannelEvent(mom *Mother, ev *slack.MemberLeftChannelEvent)
 	if ev.Channel != mom.config.ChanID {
 		return
 	}
-	chanInfo, err := mom.getChannelInfo(ev.Channel)
-	if err != nil {
+	if _, err := mom.getChannelInfo(ev.Channel); err != nil {
 		mom.log.Println(err)
 		return
 	}
-	for i, member := range chanInfo.Members {
-		if member == ev.User {
-			chanInfo.Members = append(chanInfo.Members[:i], chanInfo.Members[i+1:]...)
-			return
+	mom.updateMembers(ev.Channel, func(members []string) []string {
+		for i, member := range members {
+			if member == ev.User {
+				return append(members[:i], members[i+1:]...)
+			}
 		}
-	}
+		return members
+	})
 }
 
 // Forward emoji add between direct message and conversation threads
@@ -252,12 +202,13 @@ func handleReactionAddedEvent(mom *Mother, ev *slack.ReactionAddedEvent) {
 		return
 	}
 	if conv := mom.findConversationByTimestamp(ev.Item.Timestamp, false); conv != nil {
-		chanInfo, err := mom.getChannelInfo(ev.Item.Channel)
-		if err != nil {
-			mom.log.Println(err)
-			return
-		}
-		conv.mirrorReaction(ev.Item.Timestamp, ev.Reaction, chanInfo.IsIM || chanInfo.IsMpIM, false)
+		mom.handleOnce(eventKey(ev.Item.Channel, ev.Item.Timestamp, "reaction_added:"+ev.EventTimestamp), func() error {
+			chanInfo, err := mom.getChannelInfo(ev.Item.Channel)
+			if err != nil {
+				return err
+			}
+			return conv.mirrorReaction(ev.Item.Timestamp, ev.Reaction, chanInfo.IsIM || chanInfo.IsMpIM, false)
+		})
 	}
 }
 
@@ -267,12 +218,13 @@ func handleReactionRemovedEvent(mom *Mother, ev *slack.ReactionRemovedEvent) {
 		return
 	}
 	if conv := mom.findConversationByTimestamp(ev.Item.Timestamp, false); conv != nil {
-		chanInfo, err := mom.getChannelInfo(ev.Item.Channel)
-		if err != nil {
-			mom.log.Println(err)
-			return
-		}
-		conv.mirrorReaction(ev.Item.Timestamp, ev.Reaction, chanInfo.IsIM || chanInfo.IsMpIM, true)
+		mom.handleOnce(eventKey(ev.Item.Channel, ev.Item.Timestamp, "reaction_removed:"+ev.EventTimestamp), func() error {
+			chanInfo, err := mom.getChannelInfo(ev.Item.Channel)
+			if err != nil {
+				return err
+			}
+			return conv.mirrorReaction(ev.Item.Timestamp, ev.Reaction, chanInfo.IsIM || chanInfo.IsMpIM, true)
+		})
 	}
 }
 
@@ -291,77 +243,94 @@ func handleUserTypingEvent(mom *Mother, ev *slack.UserTypingEvent) {
 	}
 }
 
+// Handles Slack's events alongside the bot's own until it shuts down
 func handleEvents(mom *Mother) {
-	var dummyChanID *string
-	for msg := range mom.events {
-		switch ev := msg.Data.(type) {
-		case *blacklistEvent:
-			mom.blacklistUser(ev.SlackID)
-
-		case *scrubEvent:
-			mom.reapConversations()
-			mom.pruneExpired(mom.chanInfo)
-			mom.pruneExpired(mom.usersInfo)
-			mom.spoofAvailability(dummyChanID)
-
-		case *slack.ChannelJoinedEvent:
-			handleChannelJoinedEvent(mom, ev)
-
-		case *slack.ConnectionErrorEvent:
-			mom.log.Printf("Connection error (%d attempts): %s\n", ev.Attempt, ev.Error())
-
-		case *slack.ConnectedEvent:
-			mom.connectedAt = time.Now()
-			mom.log.Printf("Connected (#%d)...\n", ev.ConnectionCount+1)
-
-		case *slack.DisconnectedEvent:
-			mom.log.Printf("Disconnected (Intentional: %v, Reload: %v)...\n", ev.Intentional, mom.reload)
-			if ev.Intentional {
-				// We need the main thread to count this bot in the event of a reload to prevent premature shutdown
-				// The key will be overwritten anyway
-				if !mom.reload {
-					mothers.Delete(mom.Name)
-				}
-				close(mom.shutdown)
+	scrubTicker := time.NewTicker(time.Duration(mom.config.TimeoutCheckInterval) * time.Second)
+	defer scrubTicker.Stop()
+	for {
+		select {
+		case msg := <-mom.rtm.IncomingEvents:
+			if handleEvent(mom, msg) {
 				return
 			}
+		case <-mom.bus.ready:
+			mom.bus.deliver(mom)
+		case <-scrubTicker.C:
+			mom.bus.publish(&scrubEvent{})
+		case <-mom.shutdown:
+			return
+		}
+	}
+}
+
+// Handles a single Slack event; returns true once the bot has shut down
+func handleEvent(mom *Mother, msg slack.RTMEvent) bool {
+	defer mom.recoverPanic(msg.Data)
+	switch ev := msg.Data.(type) {
+	case *slack.ChannelJoinedEvent:
+		handleChannelJoinedEvent(mom, ev)
+
+	case *slack.ConnectionErrorEvent:
+		mom.log.Printf("Connection error (%d attempts): %s\n", ev.Attempt, ev.Error())
+
+	case *slack.ConnectedEvent:
+		mom.connectedAt = time.Now()
+		mom.log.Printf("Connected (#%d)...\n", ev.ConnectionCount+1)
+		mom.recoverMissed()
+
+	case *slack.DisconnectedEvent:
+		mom.log.Printf("Disconnected (Intentional: %v, Reload: %v)...\n", ev.Intentional, mom.reload)
+		if ev.Intentional {
+			// We need the main thread to count this bot in the event of a reload to prevent premature shutdown
+			// The key will be overwritten anyway
+			if !mom.reload {
+				mothers.Delete(mom.Name)
+			}
+			// Let conversations finish what they were doing before reporting the shutdown
+			mom.workerWG.Wait()
+			mom.closeShutdown()
+			return true
+		}
 
-		case *slack.GroupJoinedEvent:
-			handleGroupJoinedEvent(mom, ev)
+	case *slack.GroupJoinedEvent:
+		handleGroupJoinedEvent(mom, ev)
 
-		case *slack.InvalidAuthEvent:
-			mom.log.Println("Invalid credentials")
-			mothers.Delete(mom)
-			close(mom.shutdown)
-			return
+	case *slack.InvalidAuthEvent:
+		mom.log.Println("Invalid credentials")
+		mothers.Delete(mom)
+		mom.workerWG.Wait()
+		mom.closeShutdown()
+		return true
 
-		case *slack.MemberJoinedChannelEvent:
-			handleMemberJoinedChannelEvent(mom, ev)
+	case *slack.MemberJoinedChannelEvent:
+		handleMemberJoinedChannelEvent(mom, ev)
 
-		case *slack.MemberLeftChannelEvent:
-			handleMemberLeftChannelEvent(mom, ev)
+	case *slack.MemberLeftChannelEvent:
+		handleMemberLeftChannelEvent(mom, ev)
 
-		case *slack.MessageEvent:
-			handleMessageEvent(mom, ev)
+	case *slack.MessageEvent:
+		mom.dispatch(mom.messageEventKey(ev), ev, func() { handleMessageEvent(mom, ev) })
 
-		case *slack.RateLimitedError:
-			mom.log.Printf("Hitting RTM rate limit; sleeping for %d seconds\n", ev.RetryAfter)
-			time.Sleep(ev.RetryAfter * time.Second)
+	case *slack.RateLimitedError:
+		mom.log.Printf("Hitting RTM rate limit; sleeping for %d seconds\n", ev.RetryAfter)
+		time.Sleep(ev.RetryAfter * time.Second)
 
-		case *slack.ReactionAddedEvent:
-			handleReactionAddedEvent(mom, ev)
+	case *slack.ReactionAddedEvent:
+		key := mom.conversationKey(ev.Item.Channel, ev.Item.Timestamp)
+		mom.dispatch(key, ev, func() { handleReactionAddedEvent(mom, ev) })
 
-		case *slack.ReactionRemovedEvent:
-			handleReactionRemovedEvent(mom, ev)
+	case *slack.ReactionRemovedEvent:
+		key := mom.conversationKey(ev.Item.Channel, ev.Item.Timestamp)
+		mom.dispatch(key, ev, func() { handleReactionRemovedEvent(mom, ev) })
 
-		case *slack.RTMError:
-			mom.log.Println("Error:", ev.Error())
+	case *slack.RTMError:
+		mom.log.Println("Error:", ev.Error())
 
-		case *slack.UserTypingEvent:
-			handleUserTypingEvent(mom, ev)
+	case *slack.UserTypingEvent:
+		handleUserTypingEvent(mom, ev)
 
-		default:
-			// Ignore other events..
-		}
+	default:
+		// Ignore other events..
 	}
+	return false
 }
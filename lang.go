@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type (
+	langVar struct {
+		key   string
+		value interface{}
+	}
+
+	// Lang values containing template actions are rendered with text/template; all others use legacy %VAR%
+	// substitution
+	langPack struct {
+		msgs      map[string]string
+		templates map[string]*template.Template
+	}
+)
+
+var langFuncs = template.FuncMap{
+	"mention":  mention,
+	"mentions": mentions,
+	"ago":      ago,
+	"until":    until,
+	"plural":   plural,
+	"escape":   escape,
+}
+
+// Built-in language pack; keys in a configuration file's Lang override these individually
+var defaultLang = map[string]string{
+	"attachmentFailed":           "not forwarded",
+	"attachmentMirrored":         "forwarded",
+	"attachmentRejected":         "file type not allowed",
+	"attachmentTooLarge":         "too large to forward",
+	"blacklistedUser":            ">_*User <@%SLACK_ID%> can not start conversations.*_",
+	"cmdActive":                  "*Active Conversations:*",
+	"cmdActiveElement":           ">*%THREAD_LINK%* (%USER_LIST%) _%TIME_UNTIL_EXPIRED%_",
+	"cmdBlacklist":               "*Blacklisted users:*\n",
+	"cmdHelp":                    "*Commands:*\n",
+	"cmdHelpActive":              ">`active` `[page #]` - List active conversations",
+	"cmdHelpBlacklist":           ">`blacklist` `[rm]` `[@user...]` `[page #]` - View/add/remove users to blacklist",
+	"cmdHelpClose":               ">`close` `thread_id/@user...` - End active conversation",
+	"cmdHelpContact":             ">`contact` `@user...` - Start conversation with users",
+	"cmdHelpHelp":                ">`help` `[command]` - Display command help",
+	"cmdHelpHistory":             ">`history` `[-i]` `thread_id/@user...` `[page #]` - List recent conversations (`-i` includes those with other users)",
+	"cmdHelpInvite":              ">`invite` `@user...` - Invites users to channel",
+	"cmdHelpLocale":              ">`locale` `@user...` `locale/default` - Set language used for messages sent to users",
+	"cmdHelpLogs":                ">`logs` `[-m]` `[-i]` `thread_id/@user...` - Upload logs for given users or thread (`-m` merges sessions, `-i` includes those with other users)",
+	"cmdHelpResume":              ">`resume` `[-i]` `thread_id/@user...` - Resume conversation under a new thread",
+	"cmdHelpTicket":              ">`ticket` `[thread_id]` `[title]` - File a ticket with the conversation's transcript (`thread_id` may be omitted inside the thread)",
+	"cmdHelpTranscript":          ">`transcript` `[thread_id]` `[email...]` - Email the conversation's transcript to the given addresses, or to its participants (`thread_id` may be omitted inside the thread)",
+	"cmdHistory":                 "*Recent threads _(page %CURRENT_PAGE% of %TOTAL_PAGES%):_*",
+	"cmdHistoryElement":          ">*{{.THREAD_LINK}}* ({{.USER_LIST}}) _{{.LAST_UPDATED}}_{{if .TICKET_ID}} [ticket {{.TICKET_LINK}}]{{end}}",
+	"cmdLogsAttachment":          "[{{.TIMESTAMP}}] {{.DISPLAY_NAME}} uploaded {{.FILE_NAME}} ({{.FILE_SIZE}} bytes, {{.STATUS}}): {{.FILE_URL}}{{if .ARCHIVE_PATH}} [{{.ARCHIVE_PATH}}]{{end}}\n",
+	"cmdLogsMsg":                 "[%TIMESTAMP%] %DISPLAY_NAME%: %MESSAGE%\n",
+	"cmdLogsMsgEdited":           "[%TIMESTAMP%] %DISPLAY_NAME%: %MESSAGE% (edited)\n",
+	"cmdLogsNoRecords":           ">*_No records found_*",
+	"cmdLogsThread":              ">> Session %THREAD_ID% <<\n",
+	"cmdUptime":                  "*Bot Uptime:*",
+	"cmdUptimeElement":           ">*{{.BOT_NAME}}* (<@{{.BOT_SLACK_ID}}>) _{{.UPTIME}}_{{if .CRASHES}} ({{.CRASHES}} {{plural .CRASHES \"crash\" \"crashes\"}}){{end}}",
+	"cmdUptimeForeignElement":    ">*{{.BOT_NAME}}* (ID: {{.BOT_SLACK_ID}}) _{{.UPTIME}}_{{if .CRASHES}} ({{.CRASHES}} {{plural .CRASHES \"crash\" \"crashes\"}}){{end}}",
+	"cmdUptimeOffline":           "Offline",
+	"cmdUptimeStandby":           "Standing by",
+	"configInvalid":              ">_*Configuration change rejected; continuing with previous configuration.*_\n>%ERROR%",
+	"configLoaded":               ">_*Bot loaded from configuration.*_",
+	"configReloadFailed":         ">_*Configuration reload failed; still running the previous configuration.*_\n>%ERROR%",
+	"configReloaded":             ">_*Configuration change detected; bot reloaded.*_",
+	"configUnloaded":             ">_*Configuration disabled or removed; bot unloaded.*_",
+	"editTruncated":              "\n>_*Edit truncated; it exceeds the maximum message length.*_",
+	"fileTooLarge":               ">_*%FILE_NAME% not forwarded.*_\n>File exceeds maximum size limit of %MAX_FILE_SIZE% bytes.",
+	"fileTypeDenied":             ">_*%FILE_NAME% not forwarded.*_\n>Files of type `%FILE_TYPE%` are not allowed.",
+	"inConvChannel":              ">_*Users in `#%CHANNEL_NAME%` can not start conversations. Send `!help` for a list of available commands.*_",
+	"listNone":                   ">_(None)_",
+	"listPage":                   "_Page %CURRENT_PAGE% of %TOTAL_PAGES%_",
+	"messagesRecovered":          ">_*Recovered %COUNT% message(s) sent while I was offline:*_",
+	"messagesRecoveredDirect":    ">_*Recovered %COUNT% message(s) sent while I was offline:*_",
+	"msgCopyFmt":                 "*<@%SLACK_ID%>:* %MESSAGE%",
+	"reactFailure":               "x",
+	"reactSuccess":               "white_check_mark",
+	"reactUnknown":               "question",
+	"sessionContextSwitchedFrom": ">_*Session context switched from [%THREAD_LINK%].*_",
+	"sessionContextSwitchedTo":   ">_*Session context switched to [%THREAD_LINK%].*_",
+	"sessionExpiredConv":         ">_*Session [%THREAD_ID%] has expired.*_\n>Edits/reactions to previous messages will no longer be reflected in communications.",
+	"sessionExpiredDirect":       ">_*Session has expired.*_\n>If your issue has not yet been resolved, an RA will be contacting you ASAP.\n>Edits/reactions to previous messages will no longer be reflected in communications.",
+	"sessionNotice":              "_*Conversation started with: %USERS%*_\n_(converse in thread under this message)_",
+	"sessionNoticeCmd":           "_*<@%INITIATOR%> started a conversation with: %USERS%*_\n_(converse in thread under this message)_",
+	"sessionResumeConv":          ">_*Session resumed.*_",
+	"sessionResumeDirect":        ">_*An RA has resumed your session.*_",
+	"sessionResumeFrom":          ">_*Session [%THREAD_LINK%] resumed.*_",
+	"sessionResumeTo":            ">_*Session resumed at [%THREAD_LINK%].*_",
+	"sessionStartConv":           ">_*Session [%THREAD_ID%] started.*_",
+	"sessionStartDirect":         ">_*A dialogue has been started with the RA team. An RA will reach out to you shortly.*_",
+	"sessionStartNext":           ">_*Next session is [%THREAD_LINK%].*_",
+	"sessionStartPrev":           ">_*Previous session is [%THREAD_LINK%].*_",
+	"studentCmdEnd":              ">_*<@%SLACK_ID%> ended the session.*_",
+	"studentCmdStatus":           ">_*<@%SLACK_ID%> checked the session's status.*_",
+	"studentCmdTranscript":       ">_*<@%SLACK_ID%> requested a transcript of the session.*_",
+	"studentHelp":                "*Commands:*\n",
+	"studentHelpEnd":             ">`!end` - End your session",
+	"studentHelpHelp":            ">`!help` - Display this list",
+	"studentHelpStatus":          ">`!status` - Check whether an RA has replied",
+	"studentHelpTranscript":      ">`!transcript` - Receive a log of your session",
+	"studentNoSession":           ">_*You have no active session. Send a message to start one.*_",
+	"studentStatusAnswered":      ">_*An RA has replied to your session.*_",
+	"studentStatusWaiting":       ">_*Your session is waiting for an RA. Someone will reach out to you shortly.*_",
+	"studentTranscriptEmpty":     ">_*Your session has no messages yet.*_",
+	"ticketCreated":              ">_*<@%SLACK_ID%> filed ticket %TICKET_LINK% for this session.*_",
+	"ticketExists":               ">_*Ticket %TICKET_LINK% was already filed for this session.*_",
+	"ticketTitle":                "Conversation with %USER_LIST%",
+	"transcriptBody":             "Here is the transcript of your conversation with the RA team, which started %STARTED_AT%.\n\n%TRANSCRIPT%",
+	"transcriptSubject":          "Transcript of your conversation with the RA team",
+	// No longer used; kept so older configuration files still validate
+	"uploadedFile": "Uploaded a file (%FILE_URL%)",
+}
+
+func mention(slackID string) string {
+	return fmt.Sprintf("<@%s>", slackID)
+}
+
+func mentions(slackIDs []string) string {
+	tagged := make([]string, len(slackIDs))
+	for i, ID := range slackIDs {
+		tagged[i] = mention(ID)
+	}
+	return strings.Join(tagged, ", ")
+}
+
+// Describes a duration in the largest whole unit that fits, e.g. "3 minutes"
+func describeDuration(d time.Duration) string {
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+		{time.Second, "second"},
+	}
+	if d < 0 {
+		d = -d
+	}
+	for _, unit := range units {
+		if n := int64(d / unit.size); n > 0 || unit.size == time.Second {
+			return fmt.Sprintf("%d %s", n, plural(n, unit.name, unit.name+"s"))
+		}
+	}
+	return ""
+}
+
+func ago(t time.Time) string {
+	return describeDuration(time.Now().Sub(t)) + " ago"
+}
+
+func until(t time.Time) string {
+	return "in " + describeDuration(t.Sub(time.Now()))
+}
+
+func plural(n interface{}, singular, plural string) string {
+	if fmt.Sprint(n) == "1" {
+		return singular
+	}
+	return plural
+}
+
+// Escapes the characters Slack treats as control sequences in message text
+func escape(str string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(str)
+}
+
+func isTemplate(str string) bool {
+	return strings.Contains(str, "{{")
+}
+
+func parseLangTemplate(key, str string) (*template.Template, error) {
+	return template.New(key).Funcs(langFuncs).Parse(str)
+}
+
+// Built-in messages are parsed once; a template that doesn't parse is a bug, not a configuration problem
+var defaultLangPack = mustLangPack(defaultLang)
+
+func mustLangPack(msgs map[string]string) *langPack {
+	pack, err := newLangPack(msgs)
+	if err != nil {
+		panic(err)
+	}
+	return pack
+}
+
+func newLangPack(msgs map[string]string) (*langPack, error) {
+	pack := &langPack{
+		msgs:      msgs,
+		templates: make(map[string]*template.Template),
+	}
+	for key, str := range msgs {
+		if !isTemplate(str) {
+			continue
+		}
+		tmpl, err := parseLangTemplate(key, str)
+		if err != nil {
+			return nil, err
+		}
+		pack.templates[key] = tmpl
+	}
+	return pack, nil
+}
+
+func (pack *langPack) render(key string, vars []langVar) (string, error) {
+	str := pack.msgs[key]
+	tmpl, present := pack.templates[key]
+	if !present {
+		for _, subst := range vars {
+			str = strings.ReplaceAll(str, "%"+subst.key+"%", fmt.Sprint(subst.value))
+		}
+		return str, nil
+	}
+	data := make(map[string]interface{}, len(vars))
+	for _, v := range vars {
+		data[v.key] = v.value
+	}
+	buff := &strings.Builder{}
+	if err := tmpl.Execute(buff, data); err != nil {
+		return "", err
+	}
+	return buff.String(), nil
+}
+
+func (mom *Mother) getMsg(key string, vars []langVar) string {
+	return mom.getLocalMsg("", key, vars)
+}
+
+// Renders a message using the language pack for the given locale; used for messages seen by students
+func (mom *Mother) getLocalMsg(locale, key string, vars []langVar) string {
+	str, err := mom.config.localePack(locale).render(key, vars)
+	if err == nil {
+		return str
+	}
+	mom.log.Println(err)
+	// Falls back to the built-in message rather than sending a half-rendered template
+	if str, err = defaultLangPack.render(key, vars); err != nil {
+		mom.log.Println(err)
+		return ""
+	}
+	return str
+}
+
+// Returns the user's preferred locale if set, otherwise the locale from their Slack profile
+func (mom *Mother) getUserLocale(slackID string) string {
+	mom.prefsMu.RLock()
+	for _, ul := range mom.UserLocales {
+		if ul.SlackID == slackID {
+			mom.prefsMu.RUnlock()
+			return ul.Locale
+		}
+	}
+	mom.prefsMu.RUnlock()
+	// Slack only includes the profile locale in users.info when requested; the client requests it for us
+	user, err := mom.getUserInfo(slackID)
+	if err != nil {
+		mom.log.Println(err)
+		return ""
+	}
+	return user.Locale
+}
+
+// Sets the user's preferred locale; an empty locale removes the preference
+func (mom *Mother) setUserLocale(slackID, locale string) bool {
+	mom.prefsMu.Lock()
+	defer mom.prefsMu.Unlock()
+	for _, ul := range mom.UserLocales {
+		if ul.SlackID != slackID {
+			continue
+		}
+		err := db.
+			Model(mom).
+			Association("UserLocales").
+			Delete(ul).Error
+		if err != nil {
+			mom.log.Println(err)
+			return false
+		}
+		break
+	}
+	if locale == "" {
+		return true
+	}
+	ul := UserLocale{
+		MotherID: mom.ID,
+		SlackID:  slackID,
+		Locale:   locale,
+	}
+	err := db.
+		Model(mom).
+		Association("UserLocales").
+		Append(ul).Error
+	if err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	return true
+}
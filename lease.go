@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// How long a lease is held without being renewed before a standby may take over
+	leaseDuration = 30 * time.Second
+	// How often the holder renews its lease, and how often a standby checks whether it has expired
+	leaseRenewInterval = 10 * time.Second
+)
+
+// Identifies this process to other instances sharing the database; MOTHER_INSTANCE_ID overrides the default of the
+// host name and working directory
+func instanceID() string {
+	if ID := os.Getenv("MOTHER_INSTANCE_ID"); ID != "" {
+		return ID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		wd = strconv.Itoa(os.Getpid())
+	}
+	return host + ":" + wd
+}
+
+// Only the instance holding a bot's lease connects to Slack and handles its events; every other instance stands by
+// until the lease expires. A bot that starts out standing by reloads its state once it takes the lease. Runs until
+// the bot shuts down.
+func (mom *Mother) holdLease(standingBy bool) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		held := mom.acquireLease()
+		active := !mom.isStandby()
+		switch {
+		case held && !active:
+			if standingBy {
+				// The previous holder kept going while this instance waited, so its state is stale
+				mom.log.Println("Lease acquired; taking over...")
+				if err := mom.loadState(); err != nil {
+					mom.log.Println(err)
+					mom.releaseLease()
+					break
+				}
+			}
+			mom.connect()
+			go mothers.Range(blacklistBots)
+		case !held && active:
+			// Another instance took over, or may be about to while the lease can't be renewed
+			mom.log.Println("Lease lost; standing by...")
+			go mom.stepDown()
+			return
+		case !held && !standingBy:
+			mom.log.Println("Lease held by another instance; standing by...")
+			standingBy = true
+		}
+		select {
+		case <-ticker.C:
+		case <-mom.shutdown:
+			return
+		}
+	}
+}
+
+// Acquires or renews the lease; returns whether it's held. Expiry is both set and checked against the database's
+// clock, so instances on hosts whose clocks drift apart still agree on when a lease lapses
+func (mom *Mother) acquireLease() bool {
+	// Taken before the update, so the lease is never assumed to last longer than the database will honor it
+	attemptedAt := time.Now()
+	res := db.
+		Table("mothers").
+		Where("id = ?", mom.ID).
+		Where("lease_holder = ? OR lease_holder = '' OR lease_holder IS NULL OR lease_expires_at < NOW()", mom.leaseToken).
+		UpdateColumns(map[string]interface{}{
+			"lease_holder":     mom.leaseToken,
+			"lease_expires_at": gorm.Expr("DATE_ADD(NOW(), INTERVAL ? SECOND)", int(leaseDuration/time.Second)),
+		})
+	if res.Error != nil {
+		// A standby that can still reach the database takes over once the lease expires
+		mom.log.Println(res.Error)
+		return mom.leaseUnexpired(time.Now())
+	}
+	if res.RowsAffected == 1 {
+		mom.renewedLease(attemptedAt)
+		return true
+	}
+	// MySQL doesn't count a renewal that left the row as it was, e.g. one made within the same second as the last
+	var held int
+	err := db.
+		Table("mothers").
+		Where("id = ? AND lease_holder = ? AND lease_expires_at >= NOW()", mom.ID, mom.leaseToken).
+		Count(&held).Error
+	if err != nil {
+		mom.log.Println(err)
+		return mom.leaseUnexpired(time.Now())
+	}
+	if held == 1 {
+		mom.renewedLease(attemptedAt)
+	}
+	return held == 1
+}
+
+func (mom *Mother) renewedLease(at time.Time) {
+	mom.leaseMu.Lock()
+	defer mom.leaseMu.Unlock()
+	mom.leaseRenewedAt = at
+}
+
+// Returns whether the last successful renewal still covers the time until the next attempt; the lease is only
+// checked every leaseRenewInterval, so the holder has to step down that long before it expires
+func (mom *Mother) leaseUnexpired(now time.Time) bool {
+	mom.leaseMu.Lock()
+	defer mom.leaseMu.Unlock()
+	if mom.leaseRenewedAt.IsZero() {
+		return false
+	}
+	return now.Sub(mom.leaseRenewedAt)+leaseRenewInterval < leaseDuration
+}
+
+// Stops handling events at once, then starts over as a standby; retries while the database is unreachable, unless
+// the bot is reloaded or removed in the meantime
+func (mom *Mother) stepDown() {
+	mom.reload = true
+	mom.disconnect()
+	<-mom.shutdown
+	for {
+		_, err := startBot(mom.Name, mom.config)
+		if err == nil {
+			return
+		}
+		mom.log.Println(err)
+		time.Sleep(leaseRenewInterval)
+		if value, loaded := mothers.Load(mom.Name); !loaded || value.(*Mother) != mom {
+			return
+		}
+	}
+}
+
+// Gives up the lease so a standby can take over without waiting for it to expire
+func (mom *Mother) releaseLease() {
+	err := db.
+		Table("mothers").
+		Where("id = ? AND lease_holder = ?", mom.ID, mom.leaseToken).
+		UpdateColumns(map[string]interface{}{
+			"lease_holder":     "",
+			"lease_expires_at": nil,
+		}).Error
+	if err != nil {
+		mom.log.Println(err)
+	}
+}
+
+func (mom *Mother) isStandby() bool {
+	mom.leaseMu.Lock()
+	defer mom.leaseMu.Unlock()
+	return mom.rtm == nil
+}
+
+// Stops the bot; one standing by has no connection to close, so it's shut down directly
+func (mom *Mother) disconnect() {
+	mom.leaseMu.Lock()
+	rtm := mom.rtm
+	mom.leaseMu.Unlock()
+	if rtm != nil {
+		rtm.Disconnect()
+		return
+	}
+	if !mom.reload {
+		mothers.Delete(mom.Name)
+	}
+	mom.closeShutdown()
+}
+
+// Marks the bot as shut down, releasing its lease first so a reloaded instance or a standby can take over at once
+func (mom *Mother) closeShutdown() {
+	mom.shutdownOnce.Do(func() {
+		mom.releaseLease()
+		close(mom.shutdown)
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseUnexpiredAfterFailedRenewals(t *testing.T) {
+	mom := &Mother{}
+	renewedAt := time.Date(2019, time.March, 4, 15, 30, 0, 0, time.UTC)
+	if mom.leaseUnexpired(renewedAt) {
+		t.Error("a lease that was never renewed is held")
+	}
+	mom.renewedLease(renewedAt)
+	// The holder tries again every leaseRenewInterval after its last successful renewal
+	for attempt, want := range []bool{true, true, false, false} {
+		now := renewedAt.Add(time.Duration(attempt) * leaseRenewInterval)
+		if got := mom.leaseUnexpired(now); got != want {
+			t.Errorf("leaseUnexpired() %s after renewal = %v, want %v", now.Sub(renewedAt), got, want)
+		}
+		// Still holding the lease at this attempt must mean it outlasts the next one, when a standby could take over
+		if mom.leaseUnexpired(now) && !now.Add(leaseRenewInterval).Before(renewedAt.Add(leaseDuration)) {
+			t.Errorf("lease kept %s after renewal would lapse before the next attempt", now.Sub(renewedAt))
+		}
+	}
+}
@@ -1,43 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/nlopes/slack"
 )
 
-type botConfig struct {
-	Token                  string
-	ChanID                 string
-	Enabled                bool
-	AllowCommandsInChannel bool
-	MaxFileSize            int
-	SessionTimeout         int64
-	TimeoutCheckInterval   int64
-	ThreadsPerPage         int
-	Lang                   map[string]string
-}
-
 var mothers = sync.Map{}
 
 // This function should be called asynchronously
 func blacklistBots(_, value interface{}) bool {
 	mom := value.(*Mother)
-	if !mom.isOnline() {
+	// Bots standing by are blacklisted by the others once they take over
+	if !mom.isOnline() || mom.isStandby() {
 		return true
 	}
 	// Annoying Slackbot that we can't disable
-	mom.events <- slack.RTMEvent{
-		Type: "blacklist",
-		Data: &blacklistEvent{Type: "blacklist", SlackID: "USLACKBOT"},
-	}
+	mom.bus.publish(&blacklistEvent{SlackID: "USLACKBOT"})
 	// Often it takes a moment for the bot to initialize and recognize its own identity
 	for mom.rtm.GetInfo() == nil {
 		time.Sleep(time.Second)
@@ -47,7 +29,7 @@ func blacklistBots(_, value interface{}) bool {
 	}
 	mothers.Range(func(_, value interface{}) bool {
 		other := value.(*Mother)
-		if !other.isOnline() {
+		if !other.isOnline() || other.isStandby() {
 			return true
 		}
 		for other.rtm.GetInfo() == nil {
@@ -57,52 +39,103 @@ func blacklistBots(_, value interface{}) bool {
 			}
 		}
 		// Only blacklist bots located in the same workspace
-		if other.rtm.GetInfo().Team.ID == mom.rtm.GetInfo().Team.ID {
-			other.events <- slack.RTMEvent{
-				Type: "blacklist",
-				Data: &blacklistEvent{Type: "blacklist", SlackID: mom.rtm.GetInfo().User.ID},
-			}
+		if other.info().Team.ID == mom.info().Team.ID {
+			other.bus.publish(&blacklistEvent{SlackID: mom.info().User.ID})
 		}
 		return true
 	})
 	return true
 }
 
+// Creates and connects a bot instance with the given configuration
+func startBot(botName string, config botConfig) (*Mother, error) {
+	mom, err := getMother(botName, config)
+	if err != nil {
+		return nil, err
+	}
+	runBot(mom, false)
+	return mom, nil
+}
+
+// Registers a bot and connects it if it can take the lease; a bot with stale state reloads it before connecting
+func runBot(mom *Mother, stale bool) {
+	mothers.Store(mom.Name, mom)
+	// Connect right away if possible so callers can report on the bot
+	if !stale && mom.acquireLease() {
+		mom.connect()
+	}
+	go mom.holdLease(stale)
+}
+
 func loadBot(configFile os.FileInfo) bool {
-	var config botConfig
-	ext := filepath.Ext(configFile.Name())
-	if configFile.IsDir() || ext != ".json" {
+	botName, ok := configBotName(configFile)
+	if !ok {
 		return false
 	}
-	path := filepath.Join("bot_config", configFile.Name())
-	data, err := ioutil.ReadFile(path)
+	config, err := readConfig(botName)
 	if err != nil {
 		log.Println(err)
 		return false
 	}
-	if err := json.Unmarshal(data, &config); err != nil {
-		log.Println(err)
-		return false
-	}
-	botName := strings.TrimSuffix(configFile.Name(), ext)
 	if !config.Enabled {
 		log.Println(botName, "is not enabled")
 		return false
 	}
-	mom, err := getMother(botName, config)
-	if err != nil {
+	if _, err := startBot(botName, config); err != nil {
 		log.Println(err)
 		return false
 	}
-	mothers.Store(mom.Name, mom)
-	mom.connect()
 	return true
 }
 
+// Replaces a running bot with a new instance using the given configuration; blocks until complete. The running
+// instance is only stopped once the new one has been built, so it keeps going if the configuration can't be used.
+func reloadBot(mom *Mother, config botConfig) (*Mother, error) {
+	if !config.Enabled {
+		mom.disconnect()
+		<-mom.shutdown
+		mothers.Delete(mom.Name)
+		return nil, fmt.Errorf("%s is not enabled", mom.Name)
+	}
+	next, err := getMother(mom.Name, config)
+	if err != nil {
+		return nil, err
+	}
+	mom.reload = true
+	mom.disconnect()
+	// Wait for bot to fully disconnect
+	<-mom.shutdown
+	// The running instance kept handling events while the new one was built
+	stale := false
+	if err := next.loadState(); err != nil {
+		next.log.Println(err)
+		stale = true
+	}
+	runBot(next, stale)
+	go mothers.Range(blacklistBots)
+	return next, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validateConfigs())
+		case "migrate":
+			openConnection()
+			status := runMigrate(os.Args[2:])
+			db.Close()
+			os.Exit(status)
+		default:
+			log.Fatalf("Unknown command: %s\n", os.Args[1])
+		}
+	}
 	initCommands()
 	openConnection()
 	defer db.Close()
+	if err := migrateUp(latestSchemaVersion()); err != nil {
+		log.Fatal(err)
+	}
 	// Attempt to load all json configuration files in "./bot_config"
 	files, err := ioutil.ReadDir("bot_config")
 	if err != nil {
@@ -113,16 +146,7 @@ func main() {
 	}
 	// We need the bots to blacklist each other to avoid potentially looping messages
 	go mothers.Range(blacklistBots)
-	// Keep application alive until all bots are offline
-	for {
-		alive := false
-		mothers.Range(func(_, value interface{}) bool {
-			alive = true
-			return false
-		})
-		if !alive {
-			break
-		}
-		time.Sleep(10 * time.Second)
-	}
+	// Runs for as long as the application does, so configuration files added or enabled later are still loaded, even
+	// when no bot is currently online
+	watchConfigs(files)
 }
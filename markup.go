@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Prefixes distinguishing entries in namesInfo
+const (
+	channelNameKey = "#"
+	userGroupKey   = "!subteam^"
+)
+
+var (
+	markupRgx      = regexp.MustCompile("<([^<>]*)>")
+	entityReplacer = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// Decodes Slack control sequences and HTML entities into readable text
+func (mom *Mother) decodeMarkup(text string) string {
+	return entityReplacer.Replace(mom.resolveMarkup(text))
+}
+
+// Replaces Slack control sequences (mentions, channels, user groups, links) with readable text; entities are left
+// escaped so the result can be decoded again safely
+func (mom *Mother) resolveMarkup(text string) string {
+	return markupRgx.ReplaceAllStringFunc(text, func(seq string) string {
+		inner := seq[1 : len(seq)-1]
+		var label string
+		if i := strings.Index(inner, "|"); i >= 0 {
+			label = inner[i+1:]
+			inner = inner[:i]
+		}
+		switch {
+		case strings.HasPrefix(inner, "@"):
+			return mom.describeUser(inner[1:])
+		case strings.HasPrefix(inner, "#"):
+			if label != "" {
+				return "#" + label
+			}
+			return "#" + mom.getChannelName(inner[1:])
+		case strings.HasPrefix(inner, "!subteam^"):
+			if label != "" {
+				return "@" + strings.TrimPrefix(label, "@")
+			}
+			return "@" + mom.getUserGroupHandle(strings.TrimPrefix(inner, "!subteam^"))
+		case strings.HasPrefix(inner, "!date^"):
+			// Dates always carry fallback text for clients that can't format them
+			return label
+		case strings.HasPrefix(inner, "!"):
+			return "@" + inner[1:]
+		default:
+			target := strings.TrimPrefix(inner, "mailto:")
+			if label == "" || label == inner || label == target {
+				return target
+			}
+			return fmt.Sprintf("%s (%s)", label, target)
+		}
+	})
+}
+
+// Formats a user mention for transcripts as "@display_name[SLACK_ID]"
+func (mom *Mother) describeUser(slackID string) string {
+	user, err := mom.getUserInfo(slackID)
+	if err != nil {
+		mom.log.Println(err)
+		return "@" + slackID
+	}
+	displayName := user.Profile.DisplayName
+	if displayName == "" {
+		displayName = user.Name
+	}
+	return fmt.Sprintf("@%s[%s]", displayName, slackID)
+}
+
+func (mom *Mother) getChannelName(chanID string) string {
+	mom.cacheMu.RLock()
+	name, present := mom.namesInfo[channelNameKey+chanID]
+	mom.cacheMu.RUnlock()
+	if present {
+		return name.data.(string)
+	}
+	info, err := mom.rtm.GetConversationInfo(chanID, false)
+	if err != nil {
+		mom.log.Println(err)
+		return chanID
+	}
+	mom.cacheMu.Lock()
+	mom.namesInfo[channelNameKey+chanID] = expirable{data: info.Name, updatedAt: time.Now()}
+	mom.cacheMu.Unlock()
+	return info.Name
+}
+
+// User groups are fetched all at once, since there's no API for looking up a single group
+func (mom *Mother) getUserGroupHandle(groupID string) string {
+	mom.cacheMu.RLock()
+	_, present := mom.namesInfo[userGroupKey]
+	mom.cacheMu.RUnlock()
+	if !present {
+		groups, err := mom.rtm.GetUserGroups()
+		if err != nil {
+			mom.log.Println(err)
+			return groupID
+		}
+		now := time.Now()
+		mom.cacheMu.Lock()
+		mom.namesInfo[userGroupKey] = expirable{data: "", updatedAt: now}
+		for _, group := range groups {
+			mom.namesInfo[userGroupKey+group.ID] = expirable{data: group.Handle, updatedAt: now}
+		}
+		mom.cacheMu.Unlock()
+	}
+	mom.cacheMu.RLock()
+	defer mom.cacheMu.RUnlock()
+	if handle, present := mom.namesInfo[userGroupKey+groupID]; present {
+		return handle.data.(string)
+	}
+	return groupID
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type (
+	// Records each schema migration that has been applied
+	SchemaVersion struct {
+		Version   int `gorm:"primary_key;auto_increment:false"`
+		Name      string
+		AppliedAt time.Time
+	}
+
+	migration struct {
+		version int
+		name    string
+		up      func(db *gorm.DB) error
+		down    func(db *gorm.DB) error
+	}
+)
+
+// Migrations must be appended in order of version; each should define its own snapshot of any models it touches so
+// later model changes don't alter what it does
+var migrations = []migration{
+	{1, "initial schema", migrateInitialSchemaUp, migrateInitialSchemaDown},
+	{2, "conversation participants", migrateParticipantsUp, migrateParticipantsDown},
+	{3, "message attachments", migrateAttachmentsUp, migrateAttachmentsDown},
+	{4, "attachment archive", migrateArchiveUp, migrateArchiveDown},
+	{5, "raw message payloads", migrateRawPayloadUp, migrateRawPayloadDown},
+	{6, "processed events", migrateProcessedEventsUp, migrateProcessedEventsDown},
+	{7, "bot leases", migrateLeaseUp, migrateLeaseDown},
+	{8, "webhook deliveries", migrateWebhookDeliveriesUp, migrateWebhookDeliveriesDown},
+	{9, "conversation tickets", migrateTicketsUp, migrateTicketsDown},
+}
+
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+func migrateInitialSchemaUp(db *gorm.DB) error {
+	type BlacklistedUser struct {
+		gorm.Model
+		MotherID uint
+		SlackID  string
+	}
+	type Conversation struct {
+		gorm.Model
+		MotherID uint
+		SlackIDs string
+		DirectID string
+		ThreadID string
+		Active   bool
+	}
+	type MessageLog struct {
+		gorm.Model
+		ConversationID  uint
+		SlackID         string
+		Msg             string `gorm:"type:text"`
+		DirectTimestamp string
+		ConvTimestamp   string
+		Original        bool
+	}
+	type Mother struct {
+		gorm.Model
+		Name string
+	}
+	type UserLocale struct {
+		gorm.Model
+		MotherID uint
+		SlackID  string
+		Locale   string
+	}
+	// Databases created before versioning already have these tables, in which case this only fills in any gaps
+	err := db.AutoMigrate(
+		&BlacklistedUser{},
+		&Conversation{},
+		&MessageLog{},
+		&Mother{},
+		&UserLocale{},
+	).Error
+	if err != nil {
+		return err
+	}
+	if err = db.Model(&Conversation{}).AddIndex("idx_conversations_thread", "mother_id", "thread_id").Error; err != nil {
+		return err
+	}
+	if err = db.Model(&Conversation{}).AddIndex("idx_conversations_users", "mother_id", "slack_ids").Error; err != nil {
+		return err
+	}
+	return db.Model(&MessageLog{}).AddIndex("idx_message_logs_conversation", "conversation_id").Error
+}
+
+// Tables that predate versioning are left intact
+func migrateInitialSchemaDown(db *gorm.DB) error {
+	type Conversation struct{}
+	type MessageLog struct{}
+	if err := db.Model(&Conversation{}).RemoveIndex("idx_conversations_thread").Error; err != nil {
+		return err
+	}
+	if err := db.Model(&Conversation{}).RemoveIndex("idx_conversations_users").Error; err != nil {
+		return err
+	}
+	return db.Model(&MessageLog{}).RemoveIndex("idx_message_logs_conversation").Error
+}
+
+func migrateParticipantsUp(db *gorm.DB) error {
+	type ConversationParticipant struct {
+		gorm.Model
+		ConversationID uint
+		SlackID        string
+	}
+	if err := db.CreateTable(&ConversationParticipant{}).Error; err != nil {
+		return err
+	}
+	err := db.
+		Model(&ConversationParticipant{}).
+		AddIndex("idx_conversation_participants_conversation", "conversation_id").Error
+	if err != nil {
+		return err
+	}
+	err = db.
+		Model(&ConversationParticipant{}).
+		AddIndex("idx_conversation_participants_user", "slack_id").Error
+	if err != nil {
+		return err
+	}
+	// Backfill from the comma-joined list of Slack IDs on each conversation
+	rows, err := db.
+		Table("conversations").
+		Select("id, slack_ids").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var convID uint
+		var slackIDs string
+		if err := rows.Scan(&convID, &slackIDs); err != nil {
+			return err
+		}
+		for _, slackID := range strings.Split(slackIDs, ",") {
+			if slackID == "" {
+				continue
+			}
+			p := &ConversationParticipant{ConversationID: convID, SlackID: slackID}
+			if err := db.Create(p).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func migrateParticipantsDown(db *gorm.DB) error {
+	type ConversationParticipant struct{}
+	return db.DropTableIfExists(&ConversationParticipant{}).Error
+}
+
+func migrateAttachmentsUp(db *gorm.DB) error {
+	type Attachment struct {
+		gorm.Model
+		MessageLogID uint
+		FileID       string
+		Name         string
+		Filetype     string
+		Size         int
+		DirectURL    string `gorm:"type:text"`
+		ConvURL      string `gorm:"type:text"`
+		Status       string
+	}
+	type MessageLog struct {
+		gorm.Model
+		ConversationID  uint
+		Msg             string
+		DirectTimestamp string
+		ConvTimestamp   string
+	}
+	if err := db.CreateTable(&Attachment{}).Error; err != nil {
+		return err
+	}
+	err := db.
+		Model(&Attachment{}).
+		AddIndex("idx_attachments_message_log", "message_log_id").Error
+	if err != nil {
+		return err
+	}
+	// Files were previously logged as separate entries with "a" appended to their parent message's timestamps
+	var fileLogs []MessageLog
+	err = db.
+		Where("direct_timestamp LIKE ?", "%a").
+		Find(&fileLogs).Error
+	if err != nil {
+		return err
+	}
+	urlRgx := regexp.MustCompile(`https?://[^\s)>|]+`)
+	for _, fileLog := range fileLogs {
+		var parent MessageLog
+		err := db.
+			Where("conversation_id = ? AND conv_timestamp = ?",
+				fileLog.ConversationID, strings.TrimSuffix(fileLog.ConvTimestamp, "a")).
+			First(&parent).Error
+		if err == gorm.ErrRecordNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		attach := &Attachment{
+			MessageLogID: parent.ID,
+			ConvURL:      urlRgx.FindString(fileLog.Msg),
+			Status:       attachmentMirrored,
+		}
+		if err := db.Create(attach).Error; err != nil {
+			return err
+		}
+		if err := db.Delete(&fileLog).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAttachmentsDown(db *gorm.DB) error {
+	type Attachment struct{}
+	err := db.
+		Table("message_logs").
+		Where("direct_timestamp LIKE ?", "%a").
+		UpdateColumn("deleted_at", nil).Error
+	if err != nil {
+		return err
+	}
+	return db.DropTableIfExists(&Attachment{}).Error
+}
+
+func migrateArchiveUp(db *gorm.DB) error {
+	type Attachment struct {
+		ArchiveHash string
+	}
+	if err := db.AutoMigrate(&Attachment{}).Error; err != nil {
+		return err
+	}
+	return db.Model(&Attachment{}).AddIndex("idx_attachments_archive_hash", "archive_hash").Error
+}
+
+func migrateArchiveDown(db *gorm.DB) error {
+	type Attachment struct{}
+	if err := db.Model(&Attachment{}).RemoveIndex("idx_attachments_archive_hash").Error; err != nil {
+		return err
+	}
+	return db.Model(&Attachment{}).DropColumn("archive_hash").Error
+}
+
+func migrateRawPayloadUp(db *gorm.DB) error {
+	type MessageLog struct {
+		Raw string `gorm:"type:mediumtext"`
+	}
+	return db.AutoMigrate(&MessageLog{}).Error
+}
+
+func migrateRawPayloadDown(db *gorm.DB) error {
+	type MessageLog struct{}
+	return db.Model(&MessageLog{}).DropColumn("raw").Error
+}
+
+func migrateProcessedEventsUp(db *gorm.DB) error {
+	type ProcessedEvent struct {
+		ID        uint `gorm:"primary_key"`
+		MotherID  uint
+		EventKey  string
+		CreatedAt time.Time
+	}
+	if err := db.CreateTable(&ProcessedEvent{}).Error; err != nil {
+		return err
+	}
+	err := db.
+		Model(&ProcessedEvent{}).
+		AddUniqueIndex("idx_processed_events_key", "mother_id", "event_key").Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&ProcessedEvent{}).AddIndex("idx_processed_events_created_at", "created_at").Error
+}
+
+func migrateProcessedEventsDown(db *gorm.DB) error {
+	type ProcessedEvent struct{}
+	return db.DropTableIfExists(&ProcessedEvent{}).Error
+}
+
+func migrateLeaseUp(db *gorm.DB) error {
+	type Mother struct {
+		LeaseHolder    string
+		LeaseExpiresAt *time.Time
+	}
+	return db.AutoMigrate(&Mother{}).Error
+}
+
+func migrateLeaseDown(db *gorm.DB) error {
+	type Mother struct{}
+	if err := db.Model(&Mother{}).DropColumn("lease_holder").Error; err != nil {
+		return err
+	}
+	return db.Model(&Mother{}).DropColumn("lease_expires_at").Error
+}
+
+func migrateWebhookDeliveriesUp(db *gorm.DB) error {
+	type WebhookDelivery struct {
+		ID         uint `gorm:"primary_key"`
+		MotherID   uint
+		DeliveryID string
+		Event      string
+		URL        string `gorm:"type:text"`
+		Attempts   int
+		StatusCode int
+		Error      string `gorm:"type:text"`
+		Delivered  bool
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+	}
+	if err := db.CreateTable(&WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+	return db.Model(&WebhookDelivery{}).AddIndex("idx_webhook_deliveries_delivery_id", "delivery_id").Error
+}
+
+func migrateWebhookDeliveriesDown(db *gorm.DB) error {
+	type WebhookDelivery struct{}
+	return db.DropTableIfExists(&WebhookDelivery{}).Error
+}
+
+func migrateTicketsUp(db *gorm.DB) error {
+	type Conversation struct {
+		TicketID  string
+		TicketURL string `gorm:"type:text"`
+	}
+	return db.AutoMigrate(&Conversation{}).Error
+}
+
+func migrateTicketsDown(db *gorm.DB) error {
+	type Conversation struct{}
+	if err := db.Model(&Conversation{}).DropColumn("ticket_id").Error; err != nil {
+		return err
+	}
+	return db.Model(&Conversation{}).DropColumn("ticket_url").Error
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func currentSchemaVersion() (int, error) {
+	if err := db.AutoMigrate(&SchemaVersion{}).Error; err != nil {
+		return 0, err
+	}
+	var current SchemaVersion
+	err := db.
+		Order("version desc").
+		First(&current).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	return current.Version, err
+}
+
+// Applies every pending migration up to and including the target version
+func migrateUp(target int) error {
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		log.Printf("Applying migration %d (%s)...\n", m.version, m.name)
+		if err := m.up(db); err != nil {
+			return fmt.Errorf("migration %d failed: %s", m.version, err)
+		}
+		sv := SchemaVersion{Version: m.version, Name: m.name, AppliedAt: time.Now()}
+		if err := db.Create(&sv).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reverts applied migrations until the schema is at the target version
+func migrateDown(target int) error {
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		log.Printf("Reverting migration %d (%s)...\n", m.version, m.name)
+		if err := m.down(db); err != nil {
+			return fmt.Errorf("migration %d failed: %s", m.version, err)
+		}
+		if err := db.Where("version = ?", m.version).Delete(&SchemaVersion{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handles "migrate [up/down/status] [version]"; down defaults to reverting one version; returns exit status
+func runMigrate(args []string) int {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+		args = args[1:]
+	}
+	current, err := currentSchemaVersion()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	var target int
+	switch action {
+	case "up":
+		target = latestSchemaVersion()
+	case "down":
+		target = current - 1
+	case "status":
+		fmt.Printf("Schema version: %d (latest: %d)\n", current, latestSchemaVersion())
+		return 0
+	default:
+		log.Println("Unknown migrate action:", action)
+		return 1
+	}
+	if len(args) > 0 {
+		if target, err = strconv.Atoi(args[0]); err != nil || target < 0 {
+			log.Println("Invalid version:", args[0])
+			return 1
+		}
+	}
+	if action == "up" {
+		err = migrateUp(target)
+	} else {
+		err = migrateDown(target)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
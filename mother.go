@@ -4,9 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -17,18 +18,44 @@ type (
 	Mother struct {
 		gorm.Model
 		Name             string
-		Conversations    []Conversation
+		Conversations    []*Conversation
 		BlacklistedUsers []BlacklistedUser
-		chanInfo         map[string]expirable `gorm:"-"`
-		usersInfo        map[string]expirable `gorm:"-"`
-		invited          []string             `gorm:"-"`
-		config           botConfig            `gorm:"-"`
-		log              *log.Logger          `gorm:"-"`
-		rtm              *slack.RTM           `gorm:"-"`
-		events           chan slack.RTMEvent  `gorm:"-"`
-		shutdown         chan struct{}        `gorm:"-"`
-		connectedAt      time.Time            `gorm:"-"`
-		reload           bool                 `gorm:"-"`
+		UserLocales      []UserLocale
+		// Instance currently allowed to run the bot, and when its claim lapses unless renewed
+		LeaseHolder    string
+		LeaseExpiresAt *time.Time
+		chanInfo       map[string]expirable `gorm:"-"`
+		usersInfo      map[string]expirable `gorm:"-"`
+		namesInfo      map[string]expirable `gorm:"-"`
+		processed      map[string]expirable `gorm:"-"`
+		invited        []string             `gorm:"-"`
+		// Guards Conversations, along with each conversation's Active flag, UpdatedAt, ticket and timestamp indexes
+		convMu sync.RWMutex `gorm:"-"`
+		// Guards chanInfo, usersInfo, namesInfo, processed and invited
+		cacheMu sync.RWMutex `gorm:"-"`
+		// Guards BlacklistedUsers and UserLocales
+		prefsMu sync.RWMutex `gorm:"-"`
+		// Serializes conversation creation, which may happen from any worker
+		initMu     sync.Mutex              `gorm:"-"`
+		workers    map[string]*eventWorker `gorm:"-"`
+		workersMu  sync.Mutex              `gorm:"-"`
+		workerWG   sync.WaitGroup          `gorm:"-"`
+		crashes    int64                   `gorm:"-"`
+		leaseToken string                  `gorm:"-"`
+		// Guards rtm, which is only set once the lease is acquired, and leaseRenewedAt
+		leaseMu         sync.Mutex      `gorm:"-"`
+		leaseRenewedAt  time.Time       `gorm:"-"`
+		shutdownOnce    sync.Once       `gorm:"-"`
+		config          botConfig       `gorm:"-"`
+		archive         attachmentStore `gorm:"-"`
+		tickets         ticketAdapter   `gorm:"-"`
+		archivePrunedAt time.Time       `gorm:"-"`
+		log             *log.Logger     `gorm:"-"`
+		rtm             *slack.RTM      `gorm:"-"`
+		bus             *eventBus       `gorm:"-"`
+		shutdown        chan struct{}   `gorm:"-"`
+		connectedAt     time.Time       `gorm:"-"`
+		reload          bool            `gorm:"-"`
 	}
 
 	BlacklistedUser struct {
@@ -37,15 +64,18 @@ type (
 		SlackID  string
 	}
 
+	// Explicit locale preference that takes priority over a user's Slack profile locale
+	UserLocale struct {
+		gorm.Model
+		MotherID uint
+		SlackID  string
+		Locale   string
+	}
+
 	expirable struct {
 		data      interface{}
 		updatedAt time.Time
 	}
-
-	langVar struct {
-		key   string
-		value string
-	}
 )
 
 func getMother(botName string, config botConfig) (*Mother, error) {
@@ -55,23 +85,56 @@ func getMother(botName string, config botConfig) (*Mother, error) {
 		log:       log.New(os.Stdout, botName+": ", log.LstdFlags),
 		chanInfo:  make(map[string]expirable),
 		usersInfo: make(map[string]expirable),
+		namesInfo: make(map[string]expirable),
+		processed: make(map[string]expirable),
+		workers:   make(map[string]*eventWorker),
 		invited:   make([]string, 0),
+		bus:       newEventBus(),
+		shutdown:  make(chan struct{}),
 		reload:    false,
 	}
-	// Load conversations that should still be active
+	mom.subscribeHandlers()
+	// Unique to this bot instance, so a reloaded instance never mistakes its predecessor's lease for its own
+	mom.leaseToken = instanceID() + "#" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	var err error
+	if mom.archive, err = newAttachmentStore(config.Archive); err != nil {
+		return nil, err
+	}
+	if mom.tickets, err = newTicketAdapter(config.Tickets); err != nil {
+		return nil, err
+	}
+	// Conversations are loaded with their logs, which mark where each left off; anything sent since is recovered once
+	// connected
+	if err = mom.loadState(); err != nil {
+		return nil, err
+	}
+	return mom, nil
+}
+
+// Loads the bot's record, preferences and the conversations that should still be active
+func (mom *Mother) loadState() error {
+	mom.convMu.Lock()
+	defer mom.convMu.Unlock()
+	mom.prefsMu.Lock()
+	defer mom.prefsMu.Unlock()
+	mom.Conversations = nil
+	mom.BlacklistedUsers = nil
+	mom.UserLocales = nil
 	updateThreshold := time.Now().Add(-(time.Duration(mom.config.SessionTimeout) * time.Second))
 	err := db.
 		Where("name = ?", mom.Name).
 		Preload("BlacklistedUsers").
+		Preload("UserLocales").
 		Preload("Conversations", "active = ? AND updated_at > ?", true, updateThreshold,
 			func(db *gorm.DB) *gorm.DB {
 				return db.Order("conversations.direct_id desc, conversations.updated_at desc")
 			},
 		).
 		Preload("Conversations.MessageLogs").
+		Preload("Conversations.Participants").
 		FirstOrCreate(mom).Error
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// If multiple Conversations per DirectID is loaded, only the most recent should be active
 	i := 0
@@ -83,38 +146,18 @@ func getMother(botName string, config botConfig) (*Mother, error) {
 		conv.init(mom)
 		mom.Conversations[i] = conv
 		i++
-		prev = &conv
+		prev = conv
 	}
 	mom.Conversations = mom.Conversations[:i]
-	return mom, nil
+	return nil
 }
 
 func (mom *Mother) connect() {
-	mom.shutdown = make(chan struct{})
+	mom.leaseMu.Lock()
 	mom.rtm = slack.New(mom.config.Token, slack.OptionDebug(false), slack.OptionLog(mom.log)).NewRTM()
+	mom.leaseMu.Unlock()
 	go mom.rtm.ManageConnection()
-	go func(mom *Mother) {
-		// To handle each bot's events synchronously
-		mom.events = make(chan slack.RTMEvent)
-		defer close(mom.events)
-		go handleEvents(mom)
-		scrubTicker := time.NewTicker(time.Duration(mom.config.TimeoutCheckInterval) * time.Second)
-		for {
-			select {
-			// Forwards events from Slack API library to allow us to mix in our own events
-			case msg := <-mom.rtm.IncomingEvents:
-				mom.events <- msg
-			// Queues scrub event every TimeoutCheckInterval
-			case <-scrubTicker.C:
-				mom.events <- slack.RTMEvent{
-					Type: "scrub",
-					Data: &scrubEvent{Type: "scrub"},
-				}
-			case <-mom.shutdown:
-				return
-			}
-		}
-	}(mom)
+	go mom.supervise()
 }
 
 func (mom *Mother) isOnline() bool {
@@ -127,6 +170,8 @@ func (mom *Mother) isOnline() bool {
 }
 
 func (mom *Mother) isBlacklisted(slackID string) bool {
+	mom.prefsMu.RLock()
+	defer mom.prefsMu.RUnlock()
 	for _, bu := range mom.BlacklistedUsers {
 		if bu.SlackID == slackID {
 			return true
@@ -143,19 +188,24 @@ func (mom *Mother) blacklistUser(slackID string) bool {
 		MotherID: mom.ID,
 		SlackID:  slackID,
 	}
+	mom.prefsMu.Lock()
 	err := db.
 		Model(mom).
 		Association("BlacklistedUsers").
 		Append(bu).Error
+	mom.prefsMu.Unlock()
 	if err != nil {
 		mom.log.Println(err)
 		return false
 	}
+	mom.publishLifecycle(webhookPayload{Event: webhookBlacklistAdded, SlackID: slackID})
 	mom.deactivateConversations(slackID)
 	return true
 }
 
 func (mom *Mother) removeBlacklistedUser(slackID string) bool {
+	mom.prefsMu.Lock()
+	defer mom.prefsMu.Unlock()
 	for _, bu := range mom.BlacklistedUsers {
 		if bu.SlackID == slackID {
 			err := db.
@@ -166,6 +216,7 @@ func (mom *Mother) removeBlacklistedUser(slackID string) bool {
 				mom.log.Println(err)
 				return false
 			}
+			mom.publishLifecycle(webhookPayload{Event: webhookBlacklistRemoved, SlackID: slackID})
 			return true
 		}
 	}
@@ -173,16 +224,9 @@ func (mom *Mother) removeBlacklistedUser(slackID string) bool {
 }
 
 func (mom *Mother) deactivateConversations(slackID string) {
-	for i := range mom.Conversations {
-		conv := &mom.Conversations[i]
-		if !conv.Active {
-			continue
-		}
-		for _, ID := range strings.Split(conv.SlackIDs, ",") {
-			if ID == slackID {
-				conv.expire()
-				break
-			}
+	for _, conv := range mom.activeConversations() {
+		if conv.hasParticipant(slackID) {
+			conv.expire()
 		}
 	}
 	mom.reapConversations()
@@ -190,6 +234,8 @@ func (mom *Mother) deactivateConversations(slackID string) {
 
 func (mom *Mother) reapConversations() {
 	epoch := time.Now()
+	expired := make([]*Conversation, 0)
+	mom.convMu.Lock()
 	i := 0
 	for _, conv := range mom.Conversations {
 		if conv.Active && int64(epoch.Sub(conv.UpdatedAt).Seconds()) < mom.config.SessionTimeout {
@@ -198,15 +244,53 @@ func (mom *Mother) reapConversations() {
 			continue
 		}
 		if conv.Active {
-			conv.expire()
+			expired = append(expired, conv)
 		}
 	}
 	mom.Conversations = mom.Conversations[:i]
+	mom.convMu.Unlock()
+	// Expiring posts notices, so it's done without holding the lock
+	for _, conv := range expired {
+		conv.expire()
+	}
+}
+
+// Returns a snapshot of the tracked conversations that are still active
+func (mom *Mother) activeConversations() []*Conversation {
+	mom.convMu.RLock()
+	defer mom.convMu.RUnlock()
+	active := make([]*Conversation, 0, len(mom.Conversations))
+	for _, conv := range mom.Conversations {
+		if conv.Active {
+			active = append(active, conv)
+		}
+	}
+	return active
+}
+
+func (mom *Mother) trackConversation(conv *Conversation) {
+	mom.convMu.Lock()
+	defer mom.convMu.Unlock()
+	mom.Conversations = append(mom.Conversations, conv)
+}
+
+// Stops tracking the conversation; returns false if it wasn't tracked
+func (mom *Mother) untrackConversation(conv *Conversation) bool {
+	mom.convMu.Lock()
+	defer mom.convMu.Unlock()
+	for i, c := range mom.Conversations {
+		if c.ThreadID == conv.ThreadID {
+			mom.Conversations = append(mom.Conversations[:i], mom.Conversations[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 func (mom *Mother) findConversationByChannel(directID string) *Conversation {
-	for i := range mom.Conversations {
-		conv := &mom.Conversations[i]
+	mom.convMu.RLock()
+	defer mom.convMu.RUnlock()
+	for _, conv := range mom.Conversations {
 		if conv.Active && conv.DirectID == directID {
 			return conv
 		}
@@ -217,8 +301,9 @@ func (mom *Mother) findConversationByChannel(directID string) *Conversation {
 func (mom *Mother) findConversationByUsers(slackIDs []string) *Conversation {
 	sort.Strings(slackIDs)
 	seeking := strings.Join(slackIDs, ",")
-	for i := range mom.Conversations {
-		conv := &mom.Conversations[i]
+	mom.convMu.RLock()
+	defer mom.convMu.RUnlock()
+	for _, conv := range mom.Conversations {
 		if conv.Active && seeking == conv.SlackIDs {
 			return conv
 		}
@@ -226,15 +311,25 @@ func (mom *Mother) findConversationByUsers(slackIDs []string) *Conversation {
 	return nil
 }
 
+// Scopes a conversation query to those held with exactly the given users, or with at least them if inclusive
+func (mom *Mother) conversationsWithUsers(slackIDs []string, inclusive bool) *gorm.DB {
+	sort.Strings(slackIDs)
+	if !inclusive {
+		return db.Where("mother_id = ? AND slack_ids = ?", mom.ID, strings.Join(slackIDs, ","))
+	}
+	matching := db.
+		Table("conversation_participants").
+		Select("conversation_id").
+		Where("slack_id IN (?) AND deleted_at IS NULL", slackIDs).
+		Group("conversation_id").
+		Having("COUNT(DISTINCT slack_id) = ?", len(slackIDs)).
+		SubQuery()
+	return db.Where("mother_id = ? AND id IN (?)", mom.ID, matching)
+}
+
 func (mom *Mother) findConversationByTimestamp(timestamp string, loadExpired bool) *Conversation {
-	for i := range mom.Conversations {
-		conv := &mom.Conversations[i]
-		if conv.Active && conv.hasLog(timestamp) {
-			return conv
-		}
-	}
-	if !loadExpired {
-		return nil
+	if conv := mom.findTrackedByTimestamp(timestamp); conv != nil || !loadExpired {
+		return conv
 	}
 	conv, err := mom.
 		newConversation().
@@ -249,9 +344,25 @@ func (mom *Mother) findConversationByTimestamp(timestamp string, loadExpired boo
 	return conv
 }
 
+func (mom *Mother) findTrackedByTimestamp(timestamp string) *Conversation {
+	mom.convMu.RLock()
+	defer mom.convMu.RUnlock()
+	for _, conv := range mom.Conversations {
+		if conv.Active && conv.hasLog(timestamp) {
+			return conv
+		}
+	}
+	return nil
+}
+
 func (mom *Mother) getChannelInfo(chanID string) (*slack.Channel, error) {
-	if chanInfo, present := mom.chanInfo[chanID]; present {
-		return chanInfo.data.(*slack.Channel), nil
+	mom.cacheMu.RLock()
+	cached, present := mom.chanInfo[chanID]
+	mom.cacheMu.RUnlock()
+	if present {
+		if chanInfo, ok := cached.data.(*slack.Channel); ok {
+			return chanInfo, nil
+		}
 	}
 	chanInfo, err := mom.rtm.GetConversationInfo(chanID, false)
 	if err != nil {
@@ -269,29 +380,56 @@ func (mom *Mother) getChannelInfo(chanID string) (*slack.Channel, error) {
 	}
 	// Filter out the bot's slack ID from the list
 	for i, slackID := range members {
-		if slackID == mom.rtm.GetInfo().User.ID {
+		if slackID == mom.info().User.ID {
 			members = append(members[:i], members[i+1:]...)
 			break
 		}
 	}
 	sort.Strings(members)
 	chanInfo.Members = members
+	mom.cacheMu.Lock()
 	mom.chanInfo[chanID] = expirable{data: chanInfo, updatedAt: time.Now()}
+	mom.cacheMu.Unlock()
 	return chanInfo, nil
 }
 
+// Replaces a cached channel's member list; cached channels are shared between workers, so they're copied rather
+// than modified
+func (mom *Mother) updateMembers(chanID string, update func(members []string) []string) {
+	mom.cacheMu.Lock()
+	defer mom.cacheMu.Unlock()
+	cached, present := mom.chanInfo[chanID]
+	if !present {
+		return
+	}
+	prev, ok := cached.data.(*slack.Channel)
+	if !ok {
+		return
+	}
+	chanInfo := *prev
+	chanInfo.Members = update(append([]string{}, prev.Members...))
+	mom.chanInfo[chanID] = expirable{data: &chanInfo, updatedAt: cached.updatedAt}
+}
+
 func (mom *Mother) getUserInfo(slackID string) (*slack.User, error) {
-	if userInfo, present := mom.usersInfo[slackID]; present {
-		return userInfo.data.(*slack.User), nil
+	mom.cacheMu.RLock()
+	userInfo, present := mom.usersInfo[slackID]
+	mom.cacheMu.RUnlock()
+	if user, ok := userInfo.data.(*slack.User); present && ok {
+		return user, nil
 	}
 	info, err := mom.rtm.GetUserInfo(slackID)
 	if err == nil {
+		mom.cacheMu.Lock()
 		mom.usersInfo[slackID] = expirable{data: info, updatedAt: time.Now()}
+		mom.cacheMu.Unlock()
 	}
 	return info, err
 }
 
 func (mom *Mother) pruneExpired(dataMap map[string]expirable) {
+	mom.cacheMu.Lock()
+	defer mom.cacheMu.Unlock()
 	for key, data := range dataMap {
 		if int64(time.Now().Sub(data.updatedAt).Seconds()) >= mom.config.SessionTimeout {
 			delete(dataMap, key)
@@ -314,6 +452,8 @@ func (mom *Mother) hasMember(slackID string) bool {
 }
 
 func (mom *Mother) isInvited(slackID string) bool {
+	mom.cacheMu.RLock()
+	defer mom.cacheMu.RUnlock()
 	for _, invited := range mom.invited {
 		if invited == slackID {
 			return true
@@ -326,11 +466,15 @@ func (mom *Mother) inviteMember(slackID string) bool {
 	if mom.isInvited(slackID) {
 		return false
 	}
+	mom.cacheMu.Lock()
 	mom.invited = append(mom.invited, slackID)
+	mom.cacheMu.Unlock()
 	return true
 }
 
 func (mom *Mother) removeInvitation(slackID string) {
+	mom.cacheMu.Lock()
+	defer mom.cacheMu.Unlock()
 	for i, invited := range mom.invited {
 		if invited == slackID {
 			mom.invited = append(mom.invited[:i], mom.invited[i+1:]...)
@@ -349,23 +493,8 @@ func (mom *Mother) getMessageLink(timestamp string) string {
 	return fmt.Sprintf("<%s|%s>", link, timestamp)
 }
 
-func (mom *Mother) postMessage(chanID, threadID, msg string) (string, error) {
-	var timestamp string
-	var err error
-	for x := 0; timestamp == "" && x < 5; x++ {
-		_, timestamp, err = mom.rtm.PostMessage(
-			chanID,
-			slack.MsgOptionText(msg, false),
-			slack.MsgOptionTS(threadID),
-		)
-		if err != nil && strings.HasPrefix(err.Error(), "slack rate limit exceeded") {
-			// Should be plenty enough time to recover from a rate limit on this thread, but
-			// may have to switch to some sort of message queue if it doesn't work out.
-			// Could be not good to freeze the entire thread if there's heavy traffic...
-			time.Sleep(2 * time.Second)
-		}
-	}
-	return timestamp, err
+func (mom *Mother) postMessage(chanID, threadID, msg string, options ...slack.MsgOption) (string, error) {
+	return mom.postRichMessage(chanID, threadID, msg, options, nil)
 }
 
 func (mom *Mother) runCommand(ev *slack.MessageEvent, sender *slack.User, forceThreading bool) {
@@ -396,7 +525,7 @@ func (mom *Mother) runCommand(ev *slack.MessageEvent, sender *slack.User, forceT
 	)
 	if success {
 		reaction = mom.getMsg("reactSuccess", nil)
-		mom.log.Printf("<%s> %s\n", sender.Profile.DisplayName, mom.subDisplayNames(ev.Text))
+		mom.log.Printf("<%s> %s\n", sender.Profile.DisplayName, mom.decodeMarkup(ev.Text))
 	} else {
 		reaction = mom.getMsg("reactFailure", nil)
 	}
@@ -418,35 +547,3 @@ func (mom *Mother) spoofAvailability(dummyChanID *string) {
 	}
 	mom.rtm.SendMessage(mom.rtm.NewTypingMessage(*dummyChanID))
 }
-
-func (mom *Mother) subDisplayNames(msg string) string {
-	rgx := regexp.MustCompile("<@(.*?)>")
-	for {
-		res := rgx.FindStringSubmatch(msg)
-		if res == nil {
-			break
-		}
-		user, err := mom.getUserInfo(res[1])
-		if err != nil {
-			mom.log.Println(err)
-			break
-		}
-		displayName := user.Profile.DisplayName
-		if displayName == "" {
-			displayName = user.Name
-		}
-		translated := fmt.Sprintf("@%s[%s]", displayName, res[1])
-		msg = strings.ReplaceAll(msg, res[0], translated)
-	}
-	return msg
-}
-
-func (mom *Mother) getMsg(key string, vars []langVar) string {
-	str := mom.config.Lang[key]
-	if vars != nil {
-		for _, subst := range vars {
-			str = strings.ReplaceAll(str, "%"+subst.key+"%", subst.value)
-		}
-	}
-	return str
-}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/nlopes/slack"
+)
+
+// Relays messages sent to active conversations while the bot was disconnected or offline; each conversation is
+// recovered by its own worker so recovered messages stay in order with live ones
+func (mom *Mother) recoverMissed() {
+	for _, conv := range mom.activeConversations() {
+		mom.dispatch(conv.DirectID, "recovery", conv.recoverMissed)
+	}
+}
+
+func (conv *Conversation) recoverMissed() {
+	oldest := conv.lastTimestamp()
+	direct, err := conv.missedDirectMessages(oldest)
+	if err != nil {
+		conv.mom.log.Println(err)
+	} else if len(direct) > 0 {
+		notice := conv.mom.getMsg("messagesRecovered", []langVar{{"COUNT", len(direct)}})
+		if _, err := conv.postMessageToThread(notice); err != nil {
+			conv.mom.log.Println(err)
+		}
+		for i := range direct {
+			msg := &direct[i].Msg
+			conv.mom.handleOnce(eventKey(conv.DirectID, msg.Timestamp, ""), func() error {
+				return conv.relayFromDM(msg)
+			})
+		}
+	}
+	thread, err := conv.missedThreadMessages(oldest)
+	if err != nil {
+		conv.mom.log.Println(err)
+	} else if len(thread) > 0 {
+		notice := conv.getDirectMsg("messagesRecoveredDirect", []langVar{{"COUNT", len(thread)}})
+		if _, err := conv.postMessageToDM(notice); err != nil {
+			conv.mom.log.Println(err)
+		}
+		for i := range thread {
+			msg := &thread[i].Msg
+			conv.mom.handleOnce(eventKey(conv.mom.config.ChanID, msg.Timestamp, ""), func() error {
+				return conv.relayFromThread(msg)
+			})
+		}
+	}
+	if len(direct) > 0 || len(thread) > 0 {
+		conv.mom.log.Printf("Recovered %d direct and %d thread messages for %s\n", len(direct), len(thread), conv.ThreadID)
+	}
+}
+
+// Returns the most recent timestamp logged for the conversation, or its thread's if nothing has been logged
+func (conv *Conversation) lastTimestamp() string {
+	last := conv.ThreadID
+	lastTime := tsValue(last)
+	for _, entry := range conv.MessageLogs {
+		for _, ts := range []string{entry.DirectTimestamp, entry.ConvTimestamp} {
+			if t := tsValue(ts); t > lastTime {
+				last, lastTime = ts, t
+			}
+		}
+	}
+	return last
+}
+
+func tsValue(ts string) float64 {
+	value, _ := strconv.ParseFloat(ts, 64)
+	return value
+}
+
+// Fetches messages the users sent after oldest that were never relayed, oldest first
+func (conv *Conversation) missedDirectMessages(oldest string) ([]slack.Message, error) {
+	params := &slack.GetConversationHistoryParameters{
+		ChannelID: conv.DirectID,
+		Oldest:    oldest,
+		Limit:     200,
+	}
+	msgs := make([]slack.Message, 0)
+	for {
+		res, err := conv.mom.rtm.GetConversationHistory(params)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, res.Messages...)
+		if !res.HasMore || res.ResponseMetaData.NextCursor == "" {
+			break
+		}
+		params.Cursor = res.ResponseMetaData.NextCursor
+	}
+	missed := make([]slack.Message, 0)
+	// History is returned newest first
+	for i := len(msgs) - 1; i >= 0; i-- {
+		_, relayed := conv.mirrorOf(msgs[i].Timestamp, true)
+		if !relayed && conv.mom.isRecoverable(&msgs[i].Msg, true) {
+			missed = append(missed, msgs[i])
+		}
+	}
+	return missed, nil
+}
+
+// Fetches replies posted to the conversation's thread after oldest that were never relayed, oldest first
+func (conv *Conversation) missedThreadMessages(oldest string) ([]slack.Message, error) {
+	params := &slack.GetConversationRepliesParameters{
+		ChannelID: conv.mom.config.ChanID,
+		Timestamp: conv.ThreadID,
+		Oldest:    oldest,
+		Limit:     200,
+	}
+	missed := make([]slack.Message, 0)
+	for {
+		msgs, hasMore, nextCursor, err := conv.mom.rtm.GetConversationReplies(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			_, relayed := conv.mirrorOf(msg.Timestamp, false)
+			if msg.Timestamp != conv.ThreadID && !relayed && conv.mom.isRecoverable(&msg.Msg, false) {
+				missed = append(missed, msg)
+			}
+		}
+		if !hasMore || nextCursor == "" {
+			break
+		}
+		params.Cursor = nextCursor
+	}
+	return missed, nil
+}
+
+// Only plain user messages would have been relayed live; bot posts, commands and other subtypes are skipped. Like
+// handleDirectMessageEvent, only member and admin commands and enabled student commands count as commands in direct
+// messages; everything in a conversation's thread is relayed.
+func (mom *Mother) isRecoverable(msg *slack.Msg, isDirect bool) bool {
+	if msg.SubType != "" && msg.SubType != "file_share" {
+		return false
+	}
+	if msg.User == "" || msg.BotID != "" || msg.User == mom.info().User.ID || mom.isBlacklisted(msg.User) {
+		return false
+	}
+	if !isDirect || msg.Text == "" || msg.Text[0] != '!' {
+		return true
+	}
+	if mom.isStudentCommand(msg.Text) || mom.hasMember(msg.User) {
+		return false
+	}
+	sender, err := mom.getUserInfo(msg.User)
+	if err != nil {
+		// Relaying a command is less harmful than losing a message
+		mom.log.Println(err)
+		return true
+	}
+	return !sender.IsAdmin
+}
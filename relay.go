@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// Staff messages are relayed by the bot with msgCopyFmt tagging the author
+	identityTagged = "tagged"
+	// Staff messages are relayed under a shared team persona, hiding which staff member sent them
+	identityTeam = "team"
+	// Messages are relayed under the author's own display name and avatar
+	identityIndividual = "individual"
+)
+
+var (
+	mentionRgx        = regexp.MustCompile("<@([A-Z0-9]+)(\\|[^>]*)?>")
+	specialMentionRgx = regexp.MustCompile("<!(here|channel|everyone)(\\|[^>]*)?>")
+	groupMentionRgx   = regexp.MustCompile("<!subteam\\^([A-Z0-9]+)(\\|@?([^>]*))?>")
+	// Bold, italic or struck through spans containing a user tag, which could be made to look like msgCopyFmt's author
+	// prefix. Links are matched first and left alone, so delimiters inside URLs aren't mistaken for formatting, and
+	// delimiters within words are ignored like Slack does.
+	formattedMentionRgxs = []*regexp.Regexp{
+		formattedMentionRgx("*"),
+		formattedMentionRgx("_"),
+		formattedMentionRgx("~"),
+	}
+)
+
+func formattedMentionRgx(delim string) *regexp.Regexp {
+	d := regexp.QuoteMeta(delim)
+	text := "(?:[^" + d + "\\n<]|<[^>\\n]*>)*"
+	return regexp.MustCompile(
+		"<[^>\\n]*>|(^|[^\\pL\\pN])" + d + "(" + text + "<@[A-Z0-9]+(?:\\|[^>]*)?>" + text + ")" + d + "($|[^\\pL\\pN])",
+	)
+}
+
+// Strips the formatting from every span containing a user tag, including nested spans such as _*<@U1>:*_
+func unformatMentions(text string) string {
+	for {
+		prev := text
+		for _, rgx := range formattedMentionRgxs {
+			unformatted := &strings.Builder{}
+			last := 0
+			for _, match := range rgx.FindAllStringSubmatchIndex(text, -1) {
+				// Links only match as a whole, without any groups
+				if match[2] < 0 {
+					continue
+				}
+				unformatted.WriteString(text[last:match[0]])
+				for group := 1; group <= 3; group++ {
+					unformatted.WriteString(text[match[group*2]:match[group*2+1]])
+				}
+				last = match[1]
+			}
+			unformatted.WriteString(text[last:])
+			text = unformatted.String()
+		}
+		if text == prev {
+			return text
+		}
+	}
+}
+
+func isAllowed(allowed []string, mention string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(a, mention) {
+			return true
+		}
+	}
+	return false
+}
+
+// Neutralizes broadcast and user group mentions not in the allowed list, and anything that imitates the author prefix
+func sanitize(text string, allowed []string) string {
+	text = specialMentionRgx.ReplaceAllStringFunc(text, func(tagged string) string {
+		name := specialMentionRgx.FindStringSubmatch(tagged)[1]
+		if isAllowed(allowed, name) {
+			return tagged
+		}
+		// Without link_names, plain text isn't turned back into a mention
+		return "@" + name
+	})
+	text = groupMentionRgx.ReplaceAllStringFunc(text, func(tagged string) string {
+		if isAllowed(allowed, "subteam") {
+			return tagged
+		}
+		if handle := groupMentionRgx.FindStringSubmatch(tagged)[3]; handle != "" {
+			return "@" + handle
+		}
+		return "@group"
+	})
+	return unformatMentions(text)
+}
+
+// Sanitizes text from students, or from staff according to StaffAllowedMentions
+func (mom *Mother) sanitizeRelay(text string, toDirect bool) string {
+	if toDirect {
+		return sanitize(text, mom.config.StaffAllowedMentions)
+	}
+	return sanitize(text, nil)
+}
+
+// Formats a message being relayed to the other side of a conversation, with any display overrides to post it with
+func (mom *Mother) formatRelay(slackID, text string, toDirect bool) (string, []slack.MsgOption) {
+	text = mom.sanitizeRelay(text, toDirect)
+	identity := mom.config.StudentIdentity
+	if toDirect {
+		identity = mom.config.StaffIdentity
+	}
+	switch identity {
+	case identityTeam:
+		return mom.hideStaffMentions(text), mom.teamPersona()
+	case identityIndividual:
+		options, err := mom.userPersona(slackID)
+		if err == nil {
+			return text, options
+		}
+		// Fall back to tagging the author if their profile can't be fetched
+		mom.log.Println(err)
+	}
+	msg := mom.getMsg("msgCopyFmt", []langVar{
+		{"SLACK_ID", slackID},
+		{"MESSAGE", text},
+	})
+	return msg, nil
+}
+
+func (mom *Mother) teamPersona() []slack.MsgOption {
+	options := []slack.MsgOption{
+		slack.MsgOptionAsUser(false),
+		slack.MsgOptionUsername(mom.config.TeamName),
+	}
+	icon := mom.config.TeamIcon
+	if strings.HasPrefix(icon, ":") && strings.HasSuffix(icon, ":") {
+		options = append(options, slack.MsgOptionIconEmoji(icon))
+	} else if icon != "" {
+		options = append(options, slack.MsgOptionIconURL(icon))
+	}
+	return options
+}
+
+func (mom *Mother) userPersona(slackID string) ([]slack.MsgOption, error) {
+	user, err := mom.getUserInfo(slackID)
+	if err != nil {
+		return nil, err
+	}
+	name := user.Profile.DisplayName
+	if name == "" {
+		name = user.Profile.RealName
+	}
+	if name == "" {
+		name = user.Name
+	}
+	options := []slack.MsgOption{
+		slack.MsgOptionAsUser(false),
+		slack.MsgOptionUsername(name),
+	}
+	if user.Profile.Image192 != "" {
+		options = append(options, slack.MsgOptionIconURL(user.Profile.Image192))
+	}
+	return options, nil
+}
+
+// Replaces mentions of member channel users with the team name so students can't tell staff apart
+func (mom *Mother) hideStaffMentions(text string) string {
+	return mentionRgx.ReplaceAllStringFunc(text, func(tagged string) string {
+		if mom.hasMember(mentionRgx.FindStringSubmatch(tagged)[1]) {
+			return "@" + mom.config.TeamName
+		}
+		return tagged
+	})
+}
+
+// Returns a copy of the block with its text sanitized like the message text; only returns true for block types that
+// are safe to relay, since interactive blocks would act on behalf of the app that posted them, and rich_text blocks
+// only duplicate the message text
+func (mom *Mother) sanitizeBlock(block slack.Block, toDirect bool) (slack.Block, bool) {
+	switch block := block.(type) {
+	case *slack.SectionBlock:
+		section := *block
+		section.Text = mom.sanitizeTextObject(block.Text, toDirect)
+		section.Fields = make([]*slack.TextBlockObject, len(block.Fields))
+		for i, field := range block.Fields {
+			section.Fields[i] = mom.sanitizeTextObject(field, toDirect)
+		}
+		if section.Accessory != nil && section.Accessory.ImageElement == nil {
+			section.Accessory = nil
+		}
+		return &section, true
+	case *slack.ContextBlock:
+		context := *block
+		context.ContextElements.Elements = make([]slack.MixedElement, len(block.ContextElements.Elements))
+		for i, element := range block.ContextElements.Elements {
+			switch element := element.(type) {
+			case *slack.TextBlockObject:
+				context.ContextElements.Elements[i] = mom.sanitizeTextObject(element, toDirect)
+			case *slack.ImageBlockElement:
+				context.ContextElements.Elements[i] = element
+			default:
+				return nil, false
+			}
+		}
+		return &context, true
+	case *slack.ImageBlock:
+		image := *block
+		image.Title = mom.sanitizeTextObject(block.Title, toDirect)
+		return &image, true
+	case *slack.DividerBlock:
+		return block, true
+	default:
+		return nil, false
+	}
+}
+
+func (mom *Mother) sanitizeTextObject(obj *slack.TextBlockObject, toDirect bool) *slack.TextBlockObject {
+	if obj == nil {
+		return nil
+	}
+	sanitized := *obj
+	sanitized.Text = mom.sanitizeRelay(obj.Text, toDirect)
+	return &sanitized
+}
+
+// Returns options carrying over a message's legacy attachments and app blocks; text is the formatted relay text
+func (mom *Mother) richContent(text string, msg *slack.Msg, toDirect bool) []slack.MsgOption {
+	var options []slack.MsgOption
+	blocks := make([]slack.Block, 0)
+	for _, block := range msg.Blocks.BlockSet {
+		if sanitized, ok := mom.sanitizeBlock(block, toDirect); ok {
+			blocks = append(blocks, sanitized)
+		}
+	}
+	if len(blocks) > 0 && text != "" {
+		// Blocks replace the message text when displayed, so the relayed text leads them; content only follows the
+		// last chunk of a split message, so only that chunk is repeated
+		chunks := splitMessage(text, postMessageLimit)
+		header := make([]slack.Block, 0)
+		for _, section := range splitMessage(chunks[len(chunks)-1], sectionTextLimit) {
+			textBlock := slack.NewTextBlockObject(slack.MarkdownType, section, false, false)
+			header = append(header, slack.NewSectionBlock(textBlock, nil, nil))
+		}
+		blocks = append(header, blocks...)
+	}
+	// Blocks that can't all fit are left out rather than relaying only some of them
+	if len(blocks) > 0 && len(blocks) <= maxBlocks {
+		options = append(options, slack.MsgOptionBlocks(blocks...))
+	}
+	if len(msg.Attachments) > 0 {
+		attachments := make([]slack.Attachment, len(msg.Attachments))
+		for i, attach := range msg.Attachments {
+			attach.CallbackID = ""
+			attach.Actions = nil
+			attach.Pretext = mom.sanitizeRelay(attach.Pretext, toDirect)
+			attach.Text = mom.sanitizeRelay(attach.Text, toDirect)
+			attach.Fallback = mom.sanitizeRelay(attach.Fallback, toDirect)
+			attachments[i] = attach
+		}
+		options = append(options, slack.MsgOptionAttachments(attachments...))
+	}
+	return options
+}
+
+// Serializes everything a message carried so transcripts remain complete
+func rawPayload(msg *slack.Msg) string {
+	payload := struct {
+		Text        string             `json:"text,omitempty"`
+		Blocks      []slack.Block      `json:"blocks,omitempty"`
+		Attachments []slack.Attachment `json:"attachments,omitempty"`
+		Files       []slack.File       `json:"files,omitempty"`
+	}{msg.Text, msg.Blocks.BlockSet, msg.Attachments, msg.Files}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Extracts readable text carried outside of a message's text from its raw payload
+func payloadText(raw string) []string {
+	var payload struct {
+		Blocks []struct {
+			Type     string
+			Text     *struct{ Text string }
+			Elements []struct {
+				Type string
+				Text string
+			}
+		}
+		Attachments []struct {
+			Fallback string
+			Pretext  string
+			Title    string
+			Text     string
+		}
+	}
+	if raw == "" || json.Unmarshal([]byte(raw), &payload) != nil {
+		return nil
+	}
+	var lines []string
+	for _, block := range payload.Blocks {
+		if block.Type == "rich_text" {
+			continue
+		}
+		if block.Text != nil && block.Text.Text != "" {
+			lines = append(lines, block.Text.Text)
+		}
+		for _, element := range block.Elements {
+			if element.Text != "" {
+				lines = append(lines, element.Text)
+			}
+		}
+	}
+	for _, attach := range payload.Attachments {
+		parts := make([]string, 0)
+		for _, part := range []string{attach.Pretext, attach.Title, attach.Text} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) == 0 && attach.Fallback != "" {
+			parts = append(parts, attach.Fallback)
+		}
+		lines = append(lines, parts...)
+	}
+	return lines
+}
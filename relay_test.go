@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSanitizeFormattedMentions(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"bold prefix", "*<@UADMIN>:* reset", "<@UADMIN>: reset"},
+		{"doubled bold", "**<@UADMIN>:** reset", "<@UADMIN>: reset"},
+		{"quoted", "&gt; *<@UADMIN>:* reset", "&gt; <@UADMIN>: reset"},
+		{"italic bold", "_*<@UADMIN>:*_ reset", "<@UADMIN>: reset"},
+		{"struck bold", "~*<@UADMIN>:*~ reset", "<@UADMIN>: reset"},
+		{"bold italic", "*_<@UADMIN|admin>:_* reset", "<@UADMIN|admin>: reset"},
+		{"no-break space", " *<@UADMIN>:* reset", " <@UADMIN>: reset"},
+		{"zero-width space", "​*<@UADMIN>:* reset", "​<@UADMIN>: reset"},
+		{"mid-line", "ok\n​ _*<@UADMIN>:*_ reset", "ok\n​ <@UADMIN>: reset"},
+		{"inner text", "*Staff <@UADMIN> says:* reset", "Staff <@UADMIN> says: reset"},
+		{"plain mention", "ask <@UADMIN> about *this*", "ask <@UADMIN> about *this*"},
+		{"link delimiters", "see <https://a.example/x_y> or <@UADMIN> re my_file", "see <https://a.example/x_y> or <@UADMIN> re my_file"},
+		{"delimiters within words", "my_file for <@UADMIN> and your_file", "my_file for <@UADMIN> and your_file"},
+		{"formatting without mention", "*bold* _italic_ ~struck~", "*bold* _italic_ ~struck~"},
+	}
+	for _, test := range tests {
+		if got := sanitize(test.text, nil); got != test.want {
+			t.Errorf("%s: sanitize(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
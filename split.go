@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// RTM rejects messages well below the Web API limit
+	rtmMessageLimit = 4000
+	// chat.postMessage truncates text past 40k characters
+	postMessageLimit = 40000
+	// Section blocks hold at most 3k characters of text
+	sectionTextLimit = 3000
+	// Messages hold at most 50 blocks
+	maxBlocks = 50
+)
+
+// Splits msg into chunks no longer than limit characters, preferring line boundaries, then whitespace
+func splitMessage(msg string, limit int) []string {
+	if utf8.RuneCountInString(msg) <= limit {
+		return []string{msg}
+	}
+	chunks := make([]string, 0)
+	var chunk strings.Builder
+	size := 0
+	flush := func() {
+		if size > 0 {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+			size = 0
+		}
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		// Lines that can't fit in a chunk of their own are broken up on their own
+		for utf8.RuneCountInString(line) > limit {
+			flush()
+			head, tail := splitLine(line, limit)
+			chunks = append(chunks, head)
+			line = tail
+		}
+		lineSize := utf8.RuneCountInString(line)
+		if size > 0 && size+1+lineSize > limit {
+			flush()
+		}
+		if size > 0 {
+			chunk.WriteByte('\n')
+			size++
+		}
+		chunk.WriteString(line)
+		size += lineSize
+	}
+	flush()
+	return chunks
+}
+
+// Shortens msg to at most limit characters, ending it with marker if anything had to be cut; for edits, which can't
+// be split across messages
+func truncateMessage(msg string, limit int, marker string) string {
+	if utf8.RuneCountInString(msg) <= limit {
+		return msg
+	}
+	return splitMessage(msg, limit-utf8.RuneCountInString(marker))[0] + marker
+}
+
+// Breaks line after at most limit characters, at the last whitespace if there is any
+func splitLine(line string, limit int) (string, string) {
+	runes := []rune(line)
+	for i := limit; i > limit/2; i-- {
+		if runes[i] == ' ' || runes[i] == '\t' {
+			return string(runes[:i]), string(runes[i+1:])
+		}
+	}
+	return string(runes[:limit]), string(runes[limit:])
+}
+
+// Returns the slice bounds of the requested page and the total number of pages; ok is false if page is out of range
+func paginate(total, page, perPage int) (start, end, totalPages int, ok bool) {
+	totalPages = int(math.Ceil(float64(total) / float64(perPage)))
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	if page < 1 || page > totalPages {
+		return 0, 0, totalPages, false
+	}
+	start = perPage * (page - 1)
+	end = start + perPage
+	if end > total {
+		end = total
+	}
+	return start, end, totalPages, true
+}
+
+// Sends msg over RTM, split into as many messages as needed
+func (mom *Mother) sendMessage(chanID, threadID, msg string) {
+	for _, chunk := range splitMessage(msg, rtmMessageLimit) {
+		var options []slack.RTMsgOption
+		if threadID != "" {
+			options = append(options, slack.RTMsgOptionTS(threadID))
+		}
+		mom.rtm.SendMessage(mom.rtm.NewOutgoingMessage(chunk, chanID, options...))
+	}
+}
+
+// Posts msg through the Web API, split into as many messages as needed; options are applied to every message and
+// content only to the last. Returns the timestamp of the first message.
+func (mom *Mother) postRichMessage(chanID, threadID, msg string, options, content []slack.MsgOption) (string, error) {
+	var first string
+	chunks := splitMessage(msg, postMessageLimit)
+	for i, chunk := range chunks {
+		chunkOptions := append([]slack.MsgOption{}, options...)
+		if i == len(chunks)-1 {
+			chunkOptions = append(chunkOptions, content...)
+		}
+		timestamp, err := mom.postChunk(chanID, threadID, chunk, chunkOptions...)
+		if err != nil {
+			return first, err
+		}
+		if first == "" {
+			first = timestamp
+		}
+	}
+	return first, nil
+}
+
+func (mom *Mother) postChunk(chanID, threadID, msg string, options ...slack.MsgOption) (string, error) {
+	var timestamp string
+	var err error
+	options = append([]slack.MsgOption{
+		slack.MsgOptionText(msg, false),
+		slack.MsgOptionTS(threadID),
+	}, options...)
+	for x := 0; timestamp == "" && x < 5; x++ {
+		_, timestamp, err = mom.rtm.PostMessage(chanID, options...)
+		if err != nil && strings.HasPrefix(err.Error(), "slack rate limit exceeded") {
+			// Should be plenty enough time to recover from a rate limit on this thread, but
+			// may have to switch to some sort of message queue if it doesn't work out.
+			// Could be not good to freeze the entire thread if there's heavy traffic...
+			time.Sleep(2 * time.Second)
+		}
+	}
+	return timestamp, err
+}
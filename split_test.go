@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateMessageMarksLongEdits(t *testing.T) {
+	marker, err := defaultLangPack.render("editTruncated", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := "Edited message"
+	if got := truncateMessage(short, postMessageLimit, marker); got != short {
+		t.Errorf("truncateMessage() = %q, want it unchanged", got)
+	}
+	line := strings.Repeat("é", 99) + "\n"
+	edit := strings.Repeat(line, postMessageLimit/len([]rune(line))+10)
+	got := truncateMessage(edit, postMessageLimit, marker)
+	if size := utf8.RuneCountInString(got); size > postMessageLimit {
+		t.Errorf("truncated edit is %d characters, over the limit of %d", size, postMessageLimit)
+	}
+	if !strings.HasSuffix(got, marker) {
+		t.Errorf("truncated edit doesn't end with %q", marker)
+	}
+	if kept := strings.TrimSuffix(got, marker); !strings.HasPrefix(edit, kept) || !strings.HasSuffix(kept, "é") {
+		t.Error("truncated edit doesn't keep the start of the edit up to a line boundary")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nlopes/slack"
+)
+
+// Commands students may send in direct messages, which are handled instead of relayed; conv is nil without an
+// active conversation
+var studentCommands = map[string]func(mom *Mother, conv *Conversation, params cmdParams) bool{
+	"end":        studentCmdEnd,
+	"help":       studentCmdHelp,
+	"status":     studentCmdStatus,
+	"transcript": studentCmdTranscript,
+}
+
+// Returns whether the message is a student command enabled for this bot
+func (mom *Mother) isStudentCommand(text string) bool {
+	if text == "" || text[0] != '!' {
+		return false
+	}
+	cmdName := strings.ToLower(strings.Split(text, " ")[0][1:])
+	_, present := studentCommands[cmdName]
+	return present && isAllowed(mom.config.StudentCommands, cmdName)
+}
+
+func (mom *Mother) runStudentCommand(ev *slack.MessageEvent, sender *slack.User) {
+	args := strings.Split(ev.Text, " ")
+	cmd := studentCommands[strings.ToLower(args[0][1:])]
+	success := cmd(
+		mom,
+		mom.findConversationByChannel(ev.Channel),
+		cmdParams{
+			chanID: ev.Channel,
+			userID: sender.ID,
+			args:   args[1:],
+		},
+	)
+	reaction := mom.getMsg("reactFailure", nil)
+	if success {
+		reaction = mom.getMsg("reactSuccess", nil)
+		mom.log.Printf("<%s> %s\n", sender.Profile.DisplayName, mom.decodeMarkup(ev.Text))
+	}
+	if err := mom.rtm.AddReaction(reaction, slack.NewRefToMessage(ev.Channel, ev.Timestamp)); err != nil {
+		mom.log.Println(err)
+	}
+}
+
+// Renders a reply in the conversation's locale, or the student's own without a conversation
+func studentMsg(mom *Mother, conv *Conversation, params cmdParams, key string, vars []langVar) string {
+	if conv != nil {
+		return conv.getDirectMsg(key, vars)
+	}
+	return mom.getLocalMsg(mom.getUserLocale(params.userID), key, vars)
+}
+
+// Ends the student's active session
+func studentCmdEnd(mom *Mother, conv *Conversation, params cmdParams) bool {
+	if conv == nil {
+		mom.sendMessage(params.chanID, "", studentMsg(mom, conv, params, "studentNoSession", nil))
+		return true
+	}
+	conv.sendMessageToThread(mom.getMsg("studentCmdEnd", []langVar{
+		{"SLACK_ID", params.userID},
+	}))
+	conv.expire()
+	mom.reapConversations()
+	return true
+}
+
+// Tells the student whether anyone has replied in their active session yet
+func studentCmdStatus(mom *Mother, conv *Conversation, params cmdParams) bool {
+	if conv == nil {
+		mom.sendMessage(params.chanID, "", studentMsg(mom, conv, params, "studentNoSession", nil))
+		return true
+	}
+	var replies int
+	err := db.
+		Model(&MessageLog{}).
+		Where("conversation_id = ? AND slack_id NOT IN (?)", conv.ID, conv.participantIDs()).
+		Count(&replies).Error
+	if err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	key := "studentStatusWaiting"
+	if replies > 0 {
+		key = "studentStatusAnswered"
+	}
+	mom.sendMessage(params.chanID, "", conv.getDirectMsg(key, []langVar{
+		{"STARTED_AT", conv.CreatedAt},
+		{"UPDATED_AT", conv.lastUpdated()},
+	}))
+	conv.sendMessageToThread(mom.getMsg("studentCmdStatus", []langVar{
+		{"SLACK_ID", params.userID},
+	}))
+	return true
+}
+
+// Uploads the logs of the student's current or most recent session to their direct messages
+func studentCmdTranscript(mom *Mother, conv *Conversation, params cmdParams) bool {
+	last := &Conversation{mom: mom}
+	query := db.
+		Preload("MessageLogs").
+		Preload("MessageLogs.Attachments").
+		Preload("Participants")
+	var err error
+	if conv != nil {
+		err = query.First(last, conv.ID).Error
+	} else {
+		err = query.
+			Where("mother_id = ? AND direct_id = ?", mom.ID, params.chanID).
+			Order("updated_at desc, id desc").
+			First(last).Error
+	}
+	if err == gorm.ErrRecordNotFound {
+		mom.sendMessage(params.chanID, "", studentMsg(mom, conv, params, "studentNoSession", nil))
+		return true
+	}
+	if err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	buff := &bytes.Buffer{}
+	if err = writeStudentLogs(mom, buff, last); err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	if buff.Len() == 0 {
+		mom.sendMessage(params.chanID, "", last.getDirectMsg("studentTranscriptEmpty", nil))
+		return true
+	}
+	_, err = mom.rtm.UploadFile(
+		slack.FileUploadParameters{
+			Reader:   buff,
+			Filename: "Logs.txt",
+			Channels: []string{params.chanID},
+		},
+	)
+	if err != nil {
+		mom.log.Println(err)
+		return false
+	}
+	last.sendMessageToThread(mom.getMsg("studentCmdTranscript", []langVar{
+		{"SLACK_ID", params.userID},
+	}))
+	return true
+}
+
+// Lists the student commands enabled for this bot
+func studentCmdHelp(mom *Mother, conv *Conversation, params cmdParams) bool {
+	help := make([]string, 0)
+	for _, cmd := range mom.config.StudentCommands {
+		cmd = strings.ToLower(cmd)
+		key := "studentHelp" + strings.ToUpper(cmd[0:1]) + cmd[1:]
+		if lang := studentMsg(mom, conv, params, key, nil); lang != "" {
+			help = append(help, lang)
+		}
+	}
+	sort.Strings(help)
+	msg := studentMsg(mom, conv, params, "studentHelp", nil) + strings.Join(help, "\n")
+	mom.sendMessage(params.chanID, "", msg)
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Sets up a bot using the team persona whose cached member channel and profiles stand in for Slack, along with a
+// conversation between a student and a staff member
+func teamPersonaFixture() (*Mother, *Conversation) {
+	mom := &Mother{
+		config: botConfig{
+			ChanID:        "CSTAFF",
+			StaffIdentity: identityTeam,
+			TeamName:      "RA Team",
+			lang:          defaultLangPack,
+		},
+		log:       log.New(ioutil.Discard, "", 0),
+		chanInfo:  make(map[string]expirable),
+		usersInfo: make(map[string]expirable),
+		namesInfo: make(map[string]expirable),
+	}
+	staffChan := &slack.Channel{}
+	staffChan.Members = []string{"USTAFF"}
+	mom.chanInfo["CSTAFF"] = expirable{data: staffChan, updatedAt: time.Now()}
+	student := &slack.User{ID: "USTUDENT", Name: "sam"}
+	student.Profile.DisplayName = "Sam Student"
+	staff := &slack.User{ID: "USTAFF", Name: "jordan"}
+	staff.Profile.DisplayName = "Jordan Staff"
+	mom.usersInfo["USTUDENT"] = expirable{data: student, updatedAt: time.Now()}
+	mom.usersInfo["USTAFF"] = expirable{data: staff, updatedAt: time.Now()}
+	conv := &Conversation{
+		mom:          mom,
+		ThreadID:     "1551713400.000100",
+		Participants: []ConversationParticipant{{SlackID: "USTUDENT"}},
+		MessageLogs: []MessageLog{
+			{SlackID: "USTUDENT", Msg: "Is <@USTAFF> around?", ConvTimestamp: "1551713400.000100", Original: true},
+			{SlackID: "USTAFF", Msg: "Yes, how can we help?", ConvTimestamp: "1551713460.000100", Original: true},
+			{
+				SlackID:       "USTAFF",
+				ConvTimestamp: "1551713520.000100",
+				Original:      true,
+				Attachments:   []Attachment{{Name: "guide.pdf", Size: 100, Status: attachmentMirrored}},
+			},
+		},
+	}
+	return mom, conv
+}
+
+// Fails if anything identifying the fixture's staff member appears in a student-facing transcript
+func assertStaffHidden(t *testing.T, transcript string) {
+	for _, identity := range []string{"Jordan", "jordan", "USTAFF"} {
+		if strings.Contains(transcript, identity) {
+			t.Errorf("transcript reveals staff identity %q:\n%s", identity, transcript)
+		}
+	}
+}
+
+func TestWriteStudentLogsHidesStaff(t *testing.T) {
+	mom, conv := teamPersonaFixture()
+	buff := &bytes.Buffer{}
+	if err := writeStudentLogs(mom, buff, conv); err != nil {
+		t.Fatal(err)
+	}
+	transcript := buff.String()
+	assertStaffHidden(t, transcript)
+	if !strings.Contains(transcript, "Sam Student: Is @RA Team around?") {
+		t.Errorf("transcript doesn't name the student or hide the mention:\n%s", transcript)
+	}
+	if strings.Count(transcript, "RA Team") != 3 {
+		t.Errorf("transcript doesn't attribute staff messages to the team:\n%s", transcript)
+	}
+}
+
+func TestWriteStudentLogsNamesStaffIndividually(t *testing.T) {
+	mom, conv := teamPersonaFixture()
+	mom.config.StaffIdentity = identityIndividual
+	buff := &bytes.Buffer{}
+	if err := writeStudentLogs(mom, buff, conv); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buff.String(), "Jordan Staff: Yes, how can we help?") {
+		t.Errorf("transcript doesn't name staff individually:\n%s", buff.String())
+	}
+}
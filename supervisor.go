@@ -0,0 +1,68 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = 5 * time.Minute
+)
+
+// Returns the bot's connection info, or an empty placeholder until Slack has sent it
+func (mom *Mother) info() *slack.Info {
+	if mom.rtm != nil {
+		if info := mom.rtm.GetInfo(); info != nil && info.User != nil && info.Team != nil {
+			return info
+		}
+	}
+	return &slack.Info{User: &slack.UserDetails{}, Team: &slack.Team{}}
+}
+
+// Deferred around anything handling an event so that a panic is logged with the event, instead of taking down every
+// bot in the process
+func (mom *Mother) recoverPanic(event interface{}) {
+	if r := recover(); r != nil {
+		crashes := atomic.AddInt64(&mom.crashes, 1)
+		mom.log.Printf("Recovered from panic (#%d): %v\nEvent: %T %+v\n%s", crashes, r, event, event, debug.Stack())
+	}
+}
+
+func (mom *Mother) crashCount() int64 {
+	return atomic.LoadInt64(&mom.crashes)
+}
+
+// Runs the event loop, restarting it with exponential backoff whenever it dies
+func (mom *Mother) supervise() {
+	delay := minRestartDelay
+	for {
+		startedAt := time.Now()
+		if mom.runEventLoop() {
+			return
+		}
+		// A loop that stayed up for a while crashed for a different reason than the last one did
+		if time.Since(startedAt) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		mom.log.Printf("Event loop died; restarting in %s...\n", delay)
+		select {
+		case <-time.After(delay):
+		case <-mom.shutdown:
+			return
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// Returns true if the loop ended because the bot shut down
+func (mom *Mother) runEventLoop() (stopped bool) {
+	defer mom.recoverPanic("event loop")
+	handleEvents(mom)
+	return true
+}
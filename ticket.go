@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+type (
+	// Where tickets are filed; Driver is "rest", or empty to disable !ticket
+	ticketConfig struct {
+		Driver string
+		URL    string
+		// Sent as a bearer token when set
+		Token   string
+		Headers map[string]string
+		// Dot-separated paths to the ticket's ID and link in the response, "id" and "url" by default
+		IDField  string
+		URLField string
+	}
+
+	// Files tickets in an external tracker
+	ticketAdapter interface {
+		create(ticket ticketRequest) (ticketID, ticketURL string, err error)
+	}
+
+	// Everything known about a conversation when a ticket is filed for it
+	ticketRequest struct {
+		Title        string   `json:"title"`
+		Bot          string   `json:"bot"`
+		ThreadID     string   `json:"thread_id"`
+		ThreadURL    string   `json:"thread_url"`
+		Participants []string `json:"participants"`
+		RequestedBy  string   `json:"requested_by"`
+		Transcript   string   `json:"transcript"`
+	}
+
+	// Files tickets by posting them as JSON to a single endpoint; works with most trackers through a small bridge, and
+	// with a local stub server when testing
+	restTickets struct {
+		url      string
+		token    string
+		headers  map[string]string
+		idField  string
+		urlField string
+		client   *http.Client
+	}
+)
+
+var (
+	ErrUnknownTicketDriver = errors.New("unknown ticket driver")
+	ErrMissingTicketID     = errors.New("ticket response is missing an ID")
+)
+
+func newTicketAdapter(config ticketConfig) (ticketAdapter, error) {
+	switch config.Driver {
+	case "":
+		return nil, nil
+	case "rest":
+		tickets := &restTickets{
+			url:      config.URL,
+			token:    config.Token,
+			headers:  config.Headers,
+			idField:  config.IDField,
+			urlField: config.URLField,
+			client:   &http.Client{Timeout: 30 * time.Second},
+		}
+		if tickets.idField == "" {
+			tickets.idField = "id"
+		}
+		if tickets.urlField == "" {
+			tickets.urlField = "url"
+		}
+		return tickets, nil
+	default:
+		return nil, ErrUnknownTicketDriver
+	}
+}
+
+func (tickets *restTickets) create(ticket ticketRequest) (string, string, error) {
+	body, err := json.Marshal(ticket)
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, tickets.url, bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if tickets.token != "" {
+		req.Header.Set("Authorization", "Bearer "+tickets.token)
+	}
+	for name, value := range tickets.headers {
+		req.Header.Set(name, value)
+	}
+	res, err := tickets.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return "", "", fmt.Errorf("ticket creation failed: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	var created map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return "", "", err
+	}
+	ticketID := lookupField(created, tickets.idField)
+	if ticketID == "" {
+		return "", "", ErrMissingTicketID
+	}
+	return ticketID, lookupField(created, tickets.urlField), nil
+}
+
+// Follows a dot-separated path through decoded JSON objects; numbers are formatted without a fraction when possible
+func lookupField(data map[string]interface{}, path string) string {
+	var value interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		if value == float64(int64(value)) {
+			return fmt.Sprintf("%d", int64(value))
+		}
+		return fmt.Sprintf("%g", value)
+	default:
+		return ""
+	}
+}
+
+// Files a ticket for the conversation, including its transcript, and remembers it on the conversation
+func (mom *Mother) fileTicket(conv *Conversation, title, requestedBy string) error {
+	buff := &bytes.Buffer{}
+	if err := writeLogs(mom, buff, conv.MessageLogs); err != nil {
+		return err
+	}
+	slackIDs := conv.participantIDs()
+	if title == "" {
+		users := make([]string, len(slackIDs))
+		for i, slackID := range slackIDs {
+			users[i] = mom.describeUser(slackID)
+		}
+		title = mom.getMsg("ticketTitle", []langVar{
+			{"USER_LIST", strings.Join(users, ", ")},
+			{"USER_IDS", slackIDs},
+			{"THREAD_ID", conv.ThreadID},
+		})
+	}
+	// The ticket is still worth filing without a link back to the thread
+	threadURL, err := mom.rtm.GetPermalink(
+		&slack.PermalinkParameters{Channel: mom.config.ChanID, Ts: conv.ThreadID},
+	)
+	if err != nil {
+		mom.log.Println(err)
+	}
+	ticketID, ticketURL, err := mom.tickets.create(ticketRequest{
+		Title:        title,
+		Bot:          mom.Name,
+		ThreadID:     conv.ThreadID,
+		ThreadURL:    threadURL,
+		Participants: slackIDs,
+		RequestedBy:  requestedBy,
+		Transcript:   buff.String(),
+	})
+	if err != nil {
+		return err
+	}
+	err = db.
+		Table("conversations").
+		Where("id = ?", conv.ID).
+		UpdateColumns(map[string]interface{}{"ticket_id": ticketID, "ticket_url": ticketURL}).Error
+	if err != nil {
+		return err
+	}
+	conv.TicketID = ticketID
+	conv.TicketURL = ticketURL
+	// The conversation may have been loaded separately from the one tracked while it's active
+	mom.convMu.Lock()
+	for _, tracked := range mom.Conversations {
+		if tracked.ID == conv.ID {
+			tracked.TicketID = ticketID
+			tracked.TicketURL = ticketURL
+		}
+	}
+	mom.convMu.Unlock()
+	return nil
+}
+
+// Formats a ticket as a link when the tracker returned one
+func ticketLink(ticketID, ticketURL string) string {
+	if ticketURL == "" {
+		return ticketID
+	}
+	return fmt.Sprintf("<%s|%s>", ticketURL, ticketID)
+}
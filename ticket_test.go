@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Starts a stub tracker that records the ticket it receives and answers with the given status and body
+func stubTracker(t *testing.T, status int, body string, received *ticketRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer secret")
+		}
+		if got := r.Header.Get("X-Project"); got != "RA" {
+			t.Errorf("X-Project = %q, want %q", got, "RA")
+		}
+		if received != nil {
+			if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func newTestTickets(t *testing.T, url, idField, urlField string) ticketAdapter {
+	tickets, err := newTicketAdapter(ticketConfig{
+		Driver:   "rest",
+		URL:      url,
+		Token:    "secret",
+		Headers:  map[string]string{"X-Project": "RA"},
+		IDField:  idField,
+		URLField: urlField,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tickets
+}
+
+func TestRestTicketsCreate(t *testing.T) {
+	var received ticketRequest
+	server := stubTracker(t, http.StatusCreated, `{"id": 42, "url": "https://tracker.example.com/42"}`, &received)
+	defer server.Close()
+	ticket := ticketRequest{
+		Title:        "Conversation with @student[U1]",
+		Bot:          "sample",
+		ThreadID:     "1500000000.000100",
+		Participants: []string{"U1"},
+		RequestedBy:  "U2",
+		Transcript:   "[time] student: help\n",
+	}
+	ticketID, ticketURL, err := newTestTickets(t, server.URL, "", "").create(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticketID != "42" || ticketURL != "https://tracker.example.com/42" {
+		t.Errorf("create() = %q, %q; want %q, %q", ticketID, ticketURL, "42", "https://tracker.example.com/42")
+	}
+	if received.Title != ticket.Title || received.Transcript != ticket.Transcript || received.RequestedBy != "U2" {
+		t.Errorf("tracker received %+v, want %+v", received, ticket)
+	}
+}
+
+func TestRestTicketsErrorStatus(t *testing.T) {
+	server := stubTracker(t, http.StatusBadRequest, `{"error": "invalid"}`, nil)
+	defer server.Close()
+	if _, _, err := newTestTickets(t, server.URL, "", "").create(ticketRequest{}); err == nil {
+		t.Error("create() succeeded on a 400 response")
+	}
+}
+
+func TestRestTicketsMissingID(t *testing.T) {
+	server := stubTracker(t, http.StatusOK, `{"url": "https://tracker.example.com/42"}`, nil)
+	defer server.Close()
+	if _, _, err := newTestTickets(t, server.URL, "", "").create(ticketRequest{}); err != ErrMissingTicketID {
+		t.Errorf("create() error = %v, want %v", err, ErrMissingTicketID)
+	}
+}
+
+func TestRestTicketsNestedFields(t *testing.T) {
+	server := stubTracker(t, http.StatusOK, `{"data": {"id": "RA-7", "links": {"web": "https://tracker.example.com/RA-7"}}}`, nil)
+	defer server.Close()
+	ticketID, ticketURL, err := newTestTickets(t, server.URL, "data.id", "data.links.web").create(ticketRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticketID != "RA-7" || ticketURL != "https://tracker.example.com/RA-7" {
+		t.Errorf("create() = %q, %q; want %q, %q", ticketID, ticketURL, "RA-7", "https://tracker.example.com/RA-7")
+	}
+}
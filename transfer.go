@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+type (
+	// Fails writes once more than the allowed number of bytes has been written
+	limitWriter struct {
+		w         io.Writer
+		remaining int64
+	}
+
+	// Result of checking a file against a bot's attachment policy
+	filePolicy struct {
+		allowed bool
+		// Lang key explaining why the file was rejected
+		reason  string
+		maxSize int
+	}
+)
+
+// Limits how many attachments are relayed at once across all bots
+const maxConcurrentTransfers = 4
+
+var (
+	transferSlots       = make(chan struct{}, maxConcurrentTransfers)
+	ErrFileSizeExceeded = errors.New("file exceeds maximum size limit")
+)
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, ErrFileSizeExceeded
+	}
+	lw.remaining -= int64(len(p))
+	return lw.w.Write(p)
+}
+
+// Returns the lowercase identifiers a file can be matched by in policy lists: its Slack file type and extension
+func fileTypes(file slack.File) []string {
+	types := []string{strings.ToLower(file.Filetype)}
+	if ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(file.Name), ".")); ext != "" {
+		types = append(types, ext)
+	}
+	return types
+}
+
+func containsType(list []string, types []string) bool {
+	for _, listed := range list {
+		for _, t := range types {
+			if strings.EqualFold(listed, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (config *botConfig) checkFilePolicy(file slack.File) filePolicy {
+	types := fileTypes(file)
+	policy := filePolicy{allowed: true, maxSize: config.MaxFileSize}
+	for _, t := range types {
+		if size, present := config.FileTypeMaxSize[t]; present {
+			policy.maxSize = size
+			break
+		}
+	}
+	if containsType(config.DeniedFileTypes, types) ||
+		(len(config.AllowedFileTypes) > 0 && !containsType(config.AllowedFileTypes, types)) {
+		policy.allowed = false
+		policy.reason = "fileTypeDenied"
+	} else if file.Size > policy.maxSize {
+		policy.allowed = false
+		policy.reason = "fileTooLarge"
+	}
+	return policy
+}
+
+// Downloads a file from Slack to a temporary file and uploads it from there, so a failed download can't leave an
+// upload waiting on it; the same copy is saved to the archive if enabled
+func (conv *Conversation) relayFile(file slack.File, maxSize int, params slack.FileUploadParameters) (*slack.File, string, error) {
+	transferSlots <- struct{}{}
+	defer func() { <-transferSlots }()
+	spool, err := newArchiveSpool()
+	if err != nil {
+		return nil, "", err
+	}
+	defer spool.close()
+	// Slack's reported size can't be trusted to enforce the limit by itself
+	err = conv.mom.rtm.GetFile(file.URLPrivateDownload, &limitWriter{w: spool, remaining: int64(maxSize)})
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = spool.file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	params.Reader = spool.file
+	upload, err := conv.mom.rtm.UploadFile(params)
+	if err != nil {
+		return nil, "", err
+	}
+	var hash string
+	if conv.mom.archive != nil {
+		if hash, err = spool.commit(conv.mom.archive); err != nil {
+			conv.mom.log.Println(err)
+		}
+	}
+	return upload, hash, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often "./bot_config" is checked for modified configuration files
+const configCheckInterval = 5 * time.Second
+
+// Returns the bot name for a configuration file, or false if it isn't one
+func configBotName(configFile os.FileInfo) (string, bool) {
+	ext := filepath.Ext(configFile.Name())
+	if configFile.IsDir() || ext != ".json" {
+		return "", false
+	}
+	return strings.TrimSuffix(configFile.Name(), ext), true
+}
+
+// Polls "./bot_config" and loads, reloads, or unloads bots as their configuration files change
+func watchConfigs(files []os.FileInfo) {
+	modified := make(map[string]time.Time)
+	for _, configFile := range files {
+		if botName, ok := configBotName(configFile); ok {
+			modified[botName] = configFile.ModTime()
+		}
+	}
+	for {
+		time.Sleep(configCheckInterval)
+		files, err := ioutil.ReadDir("bot_config")
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		present := make(map[string]bool)
+		for _, configFile := range files {
+			botName, ok := configBotName(configFile)
+			if !ok {
+				continue
+			}
+			present[botName] = true
+			prev, seen := modified[botName]
+			if seen && prev.Equal(configFile.ModTime()) {
+				continue
+			}
+			modified[botName] = configFile.ModTime()
+			applyConfigChange(botName, seen)
+		}
+		for botName := range modified {
+			if !present[botName] {
+				delete(modified, botName)
+				removeConfig(botName)
+			}
+		}
+	}
+}
+
+// Posts a notice to the bot's member channel
+func reportConfigChange(mom *Mother, key string, vars []langVar) {
+	// Only the active instance reports
+	if mom.isStandby() {
+		return
+	}
+	if _, err := mom.postMessage(mom.config.ChanID, "", mom.getMsg(key, vars)); err != nil {
+		mom.log.Println(err)
+	}
+}
+
+// Applies a new or modified configuration file; running bots are left untouched if it is invalid
+func applyConfigChange(botName string, seen bool) {
+	config, err := readConfig(botName)
+	value, loaded := mothers.Load(botName)
+	if !loaded {
+		if err != nil {
+			log.Printf("%s: %s\n", botName, err)
+			return
+		}
+		if !config.Enabled {
+			return
+		}
+		mom, err := startBot(botName, config)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		reportConfigChange(mom, "configLoaded", nil)
+		go mothers.Range(blacklistBots)
+		return
+	}
+	mom := value.(*Mother)
+	// Bots loaded after the watcher started (e.g. with !load) are already up to date
+	if !seen || mom.reload {
+		return
+	}
+	if err != nil {
+		mom.log.Println("Configuration change rejected:", err)
+		reportConfigChange(mom, "configInvalid", []langVar{
+			{"ERROR", err.Error()},
+		})
+		return
+	}
+	if !config.Enabled {
+		reportConfigChange(mom, "configUnloaded", nil)
+		mom.disconnect()
+		return
+	}
+	next, err := reloadBot(mom, config)
+	if err != nil {
+		mom.log.Println(err)
+		reportConfigChange(mom, "configReloadFailed", []langVar{
+			{"ERROR", err.Error()},
+		})
+		return
+	}
+	reportConfigChange(next, "configReloaded", nil)
+}
+
+// Unloads the bot whose configuration file was removed
+func removeConfig(botName string) {
+	value, loaded := mothers.Load(botName)
+	if !loaded {
+		return
+	}
+	mom := value.(*Mother)
+	if mom.reload {
+		return
+	}
+	reportConfigChange(mom, "configUnloaded", nil)
+	mom.disconnect()
+}
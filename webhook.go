@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	topicLifecycle = "lifecycle"
+
+	webhookConversationStarted  = "conversation.started"
+	webhookConversationResumed  = "conversation.resumed"
+	webhookConversationSwitched = "conversation.switched"
+	webhookConversationMessage  = "conversation.message"
+	webhookConversationExpired  = "conversation.expired"
+	webhookBlacklistAdded       = "blacklist.added"
+	webhookBlacklistRemoved     = "blacklist.removed"
+
+	defaultWebhookAttempts = 5
+	maxWebhookRetryDelay   = 5 * time.Minute
+)
+
+var (
+	webhookEvents = []string{
+		webhookConversationStarted,
+		webhookConversationResumed,
+		webhookConversationSwitched,
+		webhookConversationMessage,
+		webhookConversationExpired,
+		webhookBlacklistAdded,
+		webhookBlacklistRemoved,
+	}
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type (
+	// Endpoint notified of conversation lifecycle events; Events filters which, or all of them if empty
+	webhookConfig struct {
+		URL         string
+		Secret      string
+		Events      []string
+		MaxAttempts int
+	}
+
+	// Published on the bus whenever something happens that webhooks report
+	lifecycleEvent struct {
+		payload webhookPayload
+	}
+
+	webhookPayload struct {
+		ID           string               `json:"id"`
+		Event        string               `json:"event"`
+		Bot          string               `json:"bot"`
+		Timestamp    time.Time            `json:"timestamp"`
+		Conversation *conversationPayload `json:"conversation,omitempty"`
+		Previous     *conversationPayload `json:"previous_conversation,omitempty"`
+		Message      *messagePayload      `json:"message,omitempty"`
+		SlackID      string               `json:"slack_id,omitempty"`
+	}
+
+	conversationPayload struct {
+		ID           uint      `json:"id"`
+		ThreadID     string    `json:"thread_id"`
+		DirectID     string    `json:"direct_id"`
+		Active       bool      `json:"active"`
+		Participants []string  `json:"participants"`
+		CreatedAt    time.Time `json:"created_at"`
+		UpdatedAt    time.Time `json:"updated_at"`
+	}
+
+	messagePayload struct {
+		SlackID         string `json:"slack_id"`
+		Text            string `json:"text"`
+		DirectTimestamp string `json:"direct_ts"`
+		ConvTimestamp   string `json:"conv_ts"`
+		Original        bool   `json:"original"`
+	}
+
+	// Local record of every webhook delivery and how it went
+	WebhookDelivery struct {
+		ID         uint `gorm:"primary_key"`
+		MotherID   uint
+		DeliveryID string
+		Event      string
+		URL        string `gorm:"type:text"`
+		Attempts   int
+		StatusCode int
+		Error      string `gorm:"type:text"`
+		Delivered  bool
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+	}
+)
+
+func (*lifecycleEvent) topic() string { return topicLifecycle }
+
+func (config *webhookConfig) wants(event string) bool {
+	return len(config.Events) == 0 || isAllowed(config.Events, event)
+}
+
+func validateWebhooks(webhooks []webhookConfig) []string {
+	var problems []string
+	for i, hook := range webhooks {
+		name := fmt.Sprintf("Webhooks[%d]", i)
+		if !strings.HasPrefix(hook.URL, "https://") && !strings.HasPrefix(hook.URL, "http://") {
+			problems = append(problems, name+".URL must be an http or https URL")
+		}
+		if hook.MaxAttempts < 0 {
+			problems = append(problems, name+".MaxAttempts can not be negative")
+		}
+		for _, event := range hook.Events {
+			if !isAllowed(webhookEvents, event) {
+				problems = append(problems, fmt.Sprintf("%s.Events value %q is not recognized", name, event))
+			}
+		}
+	}
+	return problems
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Describes the conversation as it is right now
+func (conv *Conversation) payload() *conversationPayload {
+	conv.mom.convMu.RLock()
+	defer conv.mom.convMu.RUnlock()
+	return &conversationPayload{
+		ID:           conv.ID,
+		ThreadID:     conv.ThreadID,
+		DirectID:     conv.DirectID,
+		Active:       conv.Active,
+		Participants: conv.participantIDs(),
+		CreatedAt:    conv.CreatedAt,
+		UpdatedAt:    conv.UpdatedAt,
+	}
+}
+
+// Publishes a lifecycle event if any webhook is configured to hear about it
+func (mom *Mother) publishLifecycle(payload webhookPayload) {
+	wanted := false
+	for _, hook := range mom.config.Webhooks {
+		wanted = wanted || hook.wants(payload.Event)
+	}
+	if !wanted {
+		return
+	}
+	payload.ID = newDeliveryID()
+	payload.Bot = mom.Name
+	payload.Timestamp = time.Now()
+	mom.bus.publish(&lifecycleEvent{payload: payload})
+}
+
+// Sends lifecycle events to the webhooks that want them; deliveries happen in the background
+func (mom *Mother) dispatchWebhooks(ev busEvent) {
+	payload := ev.(*lifecycleEvent).payload
+	body, err := json.Marshal(payload)
+	if err != nil {
+		mom.log.Println(err)
+		return
+	}
+	for _, hook := range mom.config.Webhooks {
+		if hook.wants(payload.Event) {
+			go mom.deliverWebhook(hook, payload, body)
+		}
+	}
+}
+
+// Posts body to the webhook, retrying with exponential backoff until it's accepted or attempts run out
+func (mom *Mother) deliverWebhook(hook webhookConfig, payload webhookPayload, body []byte) {
+	maxAttempts := hook.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultWebhookAttempts
+	}
+	delivery := &WebhookDelivery{
+		MotherID:   mom.ID,
+		DeliveryID: payload.ID,
+		Event:      payload.Event,
+		URL:        hook.URL,
+	}
+	err := db.Create(delivery).Error
+	if err != nil {
+		mom.log.Println(err)
+	}
+	delay := time.Second
+	for delivery.Attempts < maxAttempts {
+		delivery.Attempts++
+		delivery.StatusCode, err = postWebhook(hook, payload, body)
+		delivery.Delivered = err == nil
+		delivery.Error = ""
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := db.Save(delivery).Error; err != nil {
+			mom.log.Println(err)
+		}
+		if delivery.Delivered {
+			return
+		}
+		if delivery.Attempts < maxAttempts {
+			time.Sleep(delay)
+			if delay *= 2; delay > maxWebhookRetryDelay {
+				delay = maxWebhookRetryDelay
+			}
+		}
+	}
+	mom.log.Printf("Webhook delivery %s to %s failed after %d attempts: %s\n",
+		payload.ID, hook.URL, delivery.Attempts, delivery.Error)
+}
+
+// Returns the response status; any status outside of 2xx is an error
+func postWebhook(hook webhookConfig, payload webhookPayload, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(payload.Timestamp.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mother-Event", payload.Event)
+	req.Header.Set("X-Mother-Delivery", payload.ID)
+	req.Header.Set("X-Mother-Timestamp", timestamp)
+	if hook.Secret != "" {
+		// Signing the timestamp along with the body lets receivers reject replayed deliveries
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Mother-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
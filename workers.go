@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/nlopes/slack"
+)
+
+// Handles the events queued for one conversation in the order they arrived; exits once the queue runs dry
+type eventWorker struct {
+	pending []queuedEvent
+}
+
+type queuedEvent struct {
+	event  interface{}
+	handle func()
+}
+
+// Queues handle on the worker for key, starting one if none is running; event is only used for logging
+func (mom *Mother) dispatch(key string, event interface{}, handle func()) {
+	mom.workersMu.Lock()
+	worker, running := mom.workers[key]
+	if !running {
+		worker = &eventWorker{}
+		mom.workers[key] = worker
+		mom.workerWG.Add(1)
+	}
+	worker.pending = append(worker.pending, queuedEvent{event, handle})
+	mom.workersMu.Unlock()
+	if !running {
+		go mom.runWorker(key, worker)
+	}
+}
+
+func (mom *Mother) runWorker(key string, worker *eventWorker) {
+	defer mom.workerWG.Done()
+	for {
+		mom.workersMu.Lock()
+		if len(worker.pending) == 0 {
+			delete(mom.workers, key)
+			mom.workersMu.Unlock()
+			return
+		}
+		next := worker.pending[0]
+		worker.pending = worker.pending[1:]
+		mom.workersMu.Unlock()
+		mom.handleQueued(next)
+	}
+}
+
+func (mom *Mother) handleQueued(queued queuedEvent) {
+	defer mom.recoverPanic(queued.event)
+	queued.handle()
+}
+
+// Keys message events by the conversation they belong to; both sides of a conversation share its direct message
+// channel as a key, and anything else in the member channel (mostly commands) shares the channel's
+func (mom *Mother) messageEventKey(ev *slack.MessageEvent) string {
+	if ev.Channel != mom.config.ChanID {
+		return ev.Channel
+	}
+	timestamp := ev.ThreadTimestamp
+	if ev.SubType == "message_changed" && ev.SubMessage != nil {
+		timestamp = ev.SubMessage.Timestamp
+	}
+	return mom.conversationKey(ev.Channel, timestamp)
+}
+
+// Keys events about a message in chanID by the conversation the message belongs to
+func (mom *Mother) conversationKey(chanID, timestamp string) string {
+	if chanID != mom.config.ChanID || timestamp == "" {
+		return chanID
+	}
+	if conv := mom.findConversationByTimestamp(timestamp, false); conv != nil {
+		return conv.DirectID
+	}
+	return chanID
+}